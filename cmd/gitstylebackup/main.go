@@ -1,11 +1,13 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 
 	"github.com/bvandorf/gitstylebackup/pkg/gitstylebackup"
 )
@@ -16,18 +18,35 @@ var usageStr = `
 Gitstyle Backup v` + Version + ` - Enhanced backup tool with encryption and resumable restore
 
 Backup Options:
+    --init                  Use to create a new backup directory from the config file
 -b, --backup                Use to backup using config file
+    --rehash                Use with -b to read every file instead of reusing unchanged hashes
+-m <message>                Use with -b to record a message in the new version
+    --tag <name[,name]> [version]  Use with -b to tag the new version, alone to tag a version, current version is 0
+    --untag <name[,name]>   Use to remove tags, a tag names one version
+    --pin <version>         Use to keep a version on trim without tagging it
+    --unpin <version>       Use to let trim remove a pinned version again
+-l, --list                  Use to list the versions with who made them, when, why and what they stored
+    --all                   Use with -l to list the versions of every source, not only this one
 -t, --trim <version>        Use to trim backup directory to version's specified
            <+x>             Use to trim backup directory to keep current + x version's specified
+                              Tagged and pinned versions are always kept
 -v, --verify <version>      Use to verify files in backup directory current version is 0 
+    --diff <from> <to>      Use to list files added, removed or modified between two versions, current version is 0
 -c, --config <file>         Use to specify the config file used (default: config.txt)
     --exampleconfig <file>  Use to make an example config file
     --version               Show version information
     --fix                   Use to fix interrupted backup or trim
     --fixinuse              Use to remove inuse flag from backup
+    --migrate [dir]         Use to upgrade an older backup directory in place, or a copy of it in dir
+    --key list              Use to list the key slots of an encrypted backup directory
+    --key add <file> [name] Use to add a key slot for the password or key file in another config file
+    --key remove <id|name>  Use to remove a key slot, the last one cannot be removed
+    --key passwd <file>     Use to change the key slot of this config to the password or key file in another config file
 
 Restore Options:
 -r, --restore <version> <dir>  Use to restore backup version to specified directory
+                              Versions may be given by name, number, tag or selector here and everywhere else
                               Supports resumable two-stage process with state file
                               Default: in-place restore, use restoreStageDir in config for staging
 
@@ -40,12 +59,28 @@ case is important when defining paths in the config file
 priority in config file (1-5): 1=lowest CPU usage, 5=highest CPU usage, 3=default
 the executable directory and backup directory are automatically excluded from backup
 encryption: use encryptPassword or encryptKeyFile in config for optional encryption
+key slots: each password or key file unlocks the same master key, adding, changing or removing one does not touch stored files
 restore staging: use restoreStageDir in config to stage on different drive before restore
+chunking: set chunkSizeKB in config to store large files in content defined chunks shared between versions
+versions: new versions are named by time, e.g. 20261016-153045.123456-9f3a1c0b, a unique prefix of 4 or more characters works too
+versions: 0 or latest is the newest version, latest~3 the third before it, a date like 2026-10-16 or "2026-10-16 15:04" the newest made by then
+sources: machines sharing a backup directory each list, trim and restore their own versions, set source in config to name them, default the host name
+shard depth: set shardDepth (1-3) in config before the first backup to nest more hash folders in Files
+rehash: unchanged files reuse their previous hash, use rehashDays in config to read every file again periodically
 
 Exit Codes:
      0 = Clean
     -1 = Version or help
      1 = Error
+     2 = Backup directory is in use
+     3 = Backup version not found
+     4 = Backup files missing
+     5 = Backup files corrupt
+     6 = Wrong encryption key
+     7 = Corrupt version file
+     8 = Not a backup directory
+     9 = Backup directory needs migration
+    10 = Backup directory format not supported
 `
 
 func usage() {
@@ -61,7 +96,117 @@ func max(x, y int) int {
 	return y
 }
 
+// exitCode maps an operation error to the process exit code
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, gitstylebackup.ErrRepositoryInUse):
+		return 2
+	case errors.Is(err, gitstylebackup.ErrWrongKey):
+		return 6
+	case errors.Is(err, gitstylebackup.ErrCorruptManifest):
+		return 7
+	case errors.Is(err, gitstylebackup.ErrNotRepository):
+		return 8
+	case errors.Is(err, gitstylebackup.ErrNeedsMigration):
+		return 9
+	case errors.Is(err, gitstylebackup.ErrUnsupportedRepository):
+		return 10
+	case errors.Is(err, gitstylebackup.ErrVersionNotFound):
+		return 3
+	case errors.Is(err, gitstylebackup.ErrBlobMissing):
+		return 4
+	case errors.Is(err, gitstylebackup.ErrBlobCorrupt):
+		return 5
+	default:
+		return 1
+	}
+}
+
+// printVerifyReport prints every problem found while verifying a version
+func printVerifyReport(report gitstylebackup.VerifyReport) {
+	for _, issue := range report.MissingBlobs {
+		fmt.Printf("MISSING: %s (%s): %s\n", issue.Path, issue.Hash, issue.Err)
+	}
+	for _, issue := range report.UnreadableBlobs {
+		fmt.Printf("UNREADABLE: %s (%s): %s\n", issue.Path, issue.Hash, issue.Err)
+	}
+	for _, issue := range report.HashMismatches {
+		fmt.Printf("MISMATCH: %s expected %s got %s\n", issue.Path, issue.Hash, issue.Actual)
+	}
+	if report.Version != "" {
+		fmt.Printf("Verified version %s: %d files checked, %d problems\n",
+			report.Version, report.FilesChecked, report.Problems())
+	}
+}
+
+// printVersionList prints one block per version with what is known about it
+func printVersionList(headers []gitstylebackup.ManifestHeader) {
+	for _, h := range headers {
+		fmt.Printf("Version %s  %s", h.Version, h.Date.Local().Format("2006-01-02 15:04:05"))
+		if h.Parent != "" {
+			fmt.Printf("  parent %s", h.Parent)
+		}
+		fmt.Println()
+		if h.Host != "" || h.User != "" {
+			fmt.Printf("    by %s on %s with version %s, config %.12s\n", h.User, h.Host, h.Program, h.ConfigHash)
+		}
+		if h.Source != "" && h.Source != h.Host {
+			fmt.Printf("    source %s\n", h.Source)
+		}
+		if len(h.Includes) > 0 {
+			fmt.Printf("    include %s\n", strings.Join(h.Includes, ", "))
+		}
+		if h.Format >= 4 {
+			fmt.Printf("    %d files, %d bytes, %d new stored files, %d errors\n",
+				h.Totals.Files, h.Totals.Bytes, h.Totals.NewBlobs, h.Totals.Errors)
+		}
+		if len(h.Tags) > 0 {
+			fmt.Printf("    tags %s\n", strings.Join(h.Tags, ", "))
+		}
+		if h.Pinned {
+			fmt.Println("    pinned")
+		}
+		if h.Message != "" {
+			fmt.Printf("    %s\n", h.Message)
+		}
+	}
+}
+
+// printKeySlots prints one line per key slot
+func printKeySlots(slots []gitstylebackup.KeySlot) {
+	for _, slot := range slots {
+		fmt.Printf("Key %s  %s  %s n=%d r=%d p=%d", slot.ID, slot.Created.Local().Format("2006-01-02 15:04:05"),
+			slot.KDF, slot.N, slot.R, slot.P)
+		if slot.Name != "" {
+			fmt.Printf("  %s", slot.Name)
+		}
+		if slot.Current {
+			fmt.Print("  (this config)")
+		}
+		fmt.Println()
+	}
+}
+
+// printVersionDiff prints the files that differ between two versions
+func printVersionDiff(diff gitstylebackup.VersionDiff) {
+	for _, path := range diff.Added {
+		fmt.Println("A " + path)
+	}
+	for _, path := range diff.Modified {
+		fmt.Println("M " + path)
+	}
+	for _, path := range diff.Removed {
+		fmt.Println("D " + path)
+	}
+	fmt.Printf("Version %s to %s: %d added, %d modified, %d removed\n",
+		diff.From, diff.To, len(diff.Added), len(diff.Modified), len(diff.Removed))
+}
+
 func main() {
+	gitstylebackup.ProgramVersion = Version
+
 	// Default GOMAXPROCS will be set after reading config
 	var defaultMaxProcs = runtime.NumCPU() - 2
 
@@ -79,10 +224,42 @@ func main() {
 	var exampleConfig string
 	flag.StringVar(&exampleConfig, "exampleconfig", "", "")
 
+	var runInit bool
+	flag.BoolVar(&runInit, "init", false, "")
+
+	var runMigrate bool
+	flag.BoolVar(&runMigrate, "migrate", false, "")
+
+	var keyCommand string
+	flag.StringVar(&keyCommand, "key", "", "")
+
 	var runBackup bool
 	flag.BoolVar(&runBackup, "b", false, "")
 	flag.BoolVar(&runBackup, "backup", false, "")
 
+	var fullRehash bool
+	flag.BoolVar(&fullRehash, "rehash", false, "")
+
+	var backupMessage string
+	flag.StringVar(&backupMessage, "m", "", "")
+
+	var backupTags string
+	flag.StringVar(&backupTags, "tag", "", "")
+
+	var untagArg string
+	flag.StringVar(&untagArg, "untag", "", "")
+
+	var pinArg, unpinArg string
+	flag.StringVar(&pinArg, "pin", "", "")
+	flag.StringVar(&unpinArg, "unpin", "", "")
+
+	var runList bool
+	flag.BoolVar(&runList, "l", false, "")
+	flag.BoolVar(&runList, "list", false, "")
+
+	var listAll bool
+	flag.BoolVar(&listAll, "all", false, "")
+
 	var runTrim bool
 	var trimVersionArg = ""
 	flag.StringVar(&trimVersionArg, "t", "", "")
@@ -99,6 +276,10 @@ func main() {
 	flag.StringVar(&verifyVersionArg, "v", "", "")
 	flag.StringVar(&verifyVersionArg, "verify", "", "")
 
+	var runDiff bool
+	var diffVersionArg = ""
+	flag.StringVar(&diffVersionArg, "diff", "", "")
+
 	var runRestore bool
 	var restoreVersionArg = ""
 	flag.StringVar(&restoreVersionArg, "r", "", "")
@@ -115,6 +296,10 @@ func main() {
 		runVerify = true
 	}
 
+	if diffVersionArg != "" {
+		runDiff = true
+	}
+
 	if restoreVersionArg != "" {
 		runRestore = true
 	}
@@ -130,12 +315,36 @@ func main() {
 	}
 
 	var iCheckArgs = 0
+	if runInit {
+		iCheckArgs++
+	}
+	if runMigrate {
+		iCheckArgs++
+	}
+	if keyCommand != "" {
+		iCheckArgs++
+	}
 	if runBackup {
 		iCheckArgs++
 	}
 	if runTrim {
 		iCheckArgs++
 	}
+	if backupTags != "" && !runBackup {
+		iCheckArgs++
+	}
+	if untagArg != "" {
+		iCheckArgs++
+	}
+	if pinArg != "" {
+		iCheckArgs++
+	}
+	if unpinArg != "" {
+		iCheckArgs++
+	}
+	if runList {
+		iCheckArgs++
+	}
 	if runFix {
 		iCheckArgs++
 	}
@@ -145,6 +354,9 @@ func main() {
 	if runVerify {
 		iCheckArgs++
 	}
+	if runDiff {
+		iCheckArgs++
+	}
 	if runRestore {
 		iCheckArgs++
 	}
@@ -158,6 +370,18 @@ func main() {
 	if iCheckArgs == 0 {
 		usage()
 	}
+	if backupMessage != "" && !runBackup {
+		fmt.Println("You Can Only Use -m With -b")
+		usage()
+	}
+	if fullRehash && !runBackup {
+		fmt.Println("You Can Only Use --rehash With -b")
+		usage()
+	}
+	if listAll && !runList {
+		fmt.Println("You Can Only Use --all With -l")
+		usage()
+	}
 
 	if exampleConfig != "" {
 		var eConfig = gitstylebackup.Config{
@@ -168,8 +392,16 @@ func main() {
 			// Optional encryption (uncomment one of these):
 			// EncryptPassword: "your-password-here",
 			// EncryptKeyFile: "C:\\path\\to\\keyfile.key",
+			// Optional scrypt cost of the key of a new encrypted backup directory:
+			// KeyCost: 17,
 			// Optional restore staging directory:
 			// RestoreStageDir: "D:\\temp\\restore_stage",
+			// Optional chunking of large files, average chunk size in KB:
+			// ChunkSizeKB: 1024,
+			// Optional hash folder levels for a new backup directory:
+			// ShardDepth: 2,
+			// Optional full rehash every 30 days:
+			// RehashDays: 30,
 		}
 
 		if err := gitstylebackup.WriteConfig(exampleConfig, eConfig); err != nil {
@@ -213,39 +445,169 @@ func main() {
 	}
 	runtime.GOMAXPROCS(adjustedMaxProcs)
 
+	if runInit {
+		r, err := gitstylebackup.Init(cfg)
+		if err != nil {
+			fmt.Printf("Error during init: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		fmt.Printf("Backup directory %s ready, id %s\n", r.Dir(), r.Config().ID)
+	}
+
+	if runMigrate {
+		copyTo := ""
+		if args := flag.Args(); len(args) > 0 {
+			copyTo = args[0]
+		}
+		if err := gitstylebackup.Migrate(cfg, copyTo); err != nil {
+			fmt.Printf("Error during migrate: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+	}
+
+	if keyCommand != "" {
+		args := flag.Args()
+		var err error
+		switch {
+		case keyCommand == "list":
+			var slots []gitstylebackup.KeySlot
+			if slots, err = gitstylebackup.Keys(cfg); err == nil {
+				printKeySlots(slots)
+			}
+		case keyCommand == "add" && len(args) > 0:
+			var newKey gitstylebackup.Config
+			var slot gitstylebackup.KeySlot
+			name := ""
+			if len(args) > 1 {
+				name = args[1]
+			}
+			if newKey, err = gitstylebackup.ReadConfig(args[0]); err == nil {
+				if slot, err = gitstylebackup.AddKey(cfg, name, newKey); err == nil {
+					fmt.Printf("Added key slot %s\n", slot.ID)
+				}
+			}
+		case keyCommand == "remove" && len(args) > 0:
+			err = gitstylebackup.RemoveKey(cfg, args[0])
+		case keyCommand == "passwd" && len(args) > 0:
+			var newKey gitstylebackup.Config
+			if newKey, err = gitstylebackup.ReadConfig(args[0]); err == nil {
+				err = gitstylebackup.ChangeKey(cfg, newKey)
+			}
+		default:
+			fmt.Println("Error: Unknown key command or missing argument")
+			fmt.Println("Usage: --key list | add <file> [name] | remove <id|name> | passwd <file>")
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Printf("Error during key %s: %v\n", keyCommand, err)
+			os.Exit(exitCode(err))
+		}
+	}
+
 	if runBackup {
+		cfg.FullRehash = fullRehash
+		cfg.Message = backupMessage
+		if backupTags != "" {
+			cfg.Tags = strings.Split(backupTags, ",")
+		}
 		if err := gitstylebackup.Backup(cfg); err != nil {
 			fmt.Printf("Error during backup: %v\n", err)
-			os.Exit(1)
+			os.Exit(exitCode(err))
 		}
 	}
 
 	if runTrim {
-		if err := gitstylebackup.Trim(cfg, trimVersionArg); err != nil {
+		result, err := gitstylebackup.Trim(cfg, trimVersionArg)
+		if err != nil {
 			fmt.Printf("Error during trim: %v\n", err)
-			os.Exit(1)
+			os.Exit(exitCode(err))
+		}
+		fmt.Printf("Trim removed %d versions and %d files, reclaimed %d bytes, kept %d tagged or pinned versions\n",
+			result.VersionsRemoved, result.BlobsRemoved, result.BytesReclaimed, result.VersionsProtected)
+	}
+
+	if backupTags != "" && !runBackup {
+		version := "0"
+		if args := flag.Args(); len(args) > 0 {
+			version = args[0]
+		}
+		if err := gitstylebackup.Tag(cfg, version, strings.Split(backupTags, ",")...); err != nil {
+			fmt.Printf("Error during tag: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+	}
+
+	if untagArg != "" {
+		if err := gitstylebackup.Untag(cfg, strings.Split(untagArg, ",")...); err != nil {
+			fmt.Printf("Error during untag: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+	}
+
+	if pinArg != "" {
+		if err := gitstylebackup.Pin(cfg, pinArg); err != nil {
+			fmt.Printf("Error during pin: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+	}
+
+	if unpinArg != "" {
+		if err := gitstylebackup.Unpin(cfg, unpinArg); err != nil {
+			fmt.Printf("Error during unpin: %v\n", err)
+			os.Exit(exitCode(err))
 		}
 	}
 
+	if runList {
+		listVersions := gitstylebackup.ListVersions
+		if listAll {
+			listVersions = gitstylebackup.ListAllVersions
+		}
+		headers, err := listVersions(cfg)
+		if err != nil {
+			fmt.Printf("Error listing versions: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		printVersionList(headers)
+	}
+
 	if runFix {
 		if err := gitstylebackup.Fix(cfg); err != nil {
 			fmt.Printf("Error during fix: %v\n", err)
-			os.Exit(1)
+			os.Exit(exitCode(err))
 		}
 	}
 
 	if runFixInuse {
 		if err := gitstylebackup.FixInUse(cfg); err != nil {
 			fmt.Printf("Error during fix in-use: %v\n", err)
-			os.Exit(1)
+			os.Exit(exitCode(err))
 		}
 	}
 
 	if runVerify {
-		if err := gitstylebackup.Verify(cfg, verifyVersionArg); err != nil {
+		report, err := gitstylebackup.Verify(cfg, verifyVersionArg)
+		printVerifyReport(report)
+		if err != nil {
 			fmt.Printf("Error during verify: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+	}
+
+	if runDiff {
+		args := flag.Args()
+		if len(args) < 1 {
+			fmt.Println("Error: Diff requires two versions")
+			fmt.Println("Usage: --diff <from> <to>")
 			os.Exit(1)
 		}
+
+		diff, err := gitstylebackup.Diff(cfg, diffVersionArg, args[0])
+		if err != nil {
+			fmt.Printf("Error during diff: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		printVersionDiff(diff)
 	}
 
 	if runRestore {
@@ -260,7 +622,7 @@ func main() {
 		restoreDir := args[0]
 		if err := gitstylebackup.Restore(cfg, restoreVersionArg, restoreDir); err != nil {
 			fmt.Printf("Error during restore: %v\n", err)
-			os.Exit(1)
+			os.Exit(exitCode(err))
 		}
 	}
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bvandorf/gitstylebackup/pkg/gitstylebackup"
+)
+
+// TestExitCodeCorruptEncryptedBlob tests that restoring a damaged file of an
+// encrypted backup directory exits as corrupt, not as a wrong key
+func TestExitCodeCorruptEncryptedBlob(t *testing.T) {
+	tempDir := t.TempDir()
+	sourceDir := filepath.Join(tempDir, "source")
+	backupDir := filepath.Join(tempDir, "backup")
+
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		t.Fatalf("Failed to create source directory: %v", err)
+	}
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := os.WriteFile(filepath.Join(sourceDir, "large.bin"), data, 0644); err != nil {
+		t.Fatalf("Failed to create source file: %v", err)
+	}
+
+	cfg := gitstylebackup.Config{BackupDir: backupDir, Include: []string{sourceDir}, EncryptPassword: "secret", KeyCost: 10}
+	if err := gitstylebackup.Backup(cfg); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	// the largest stored file is the loose one, damage it past its first segment
+	var blob string
+	var size int64
+	filepath.Walk(filepath.Join(backupDir, "Files"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && info.Size() > size {
+			blob, size = path, info.Size()
+		}
+		return nil
+	})
+	stored, err := os.ReadFile(blob)
+	if err != nil {
+		t.Fatalf("Failed to read stored file: %v", err)
+	}
+	stored[len(stored)/2] ^= 1
+	if err := os.WriteFile(blob, stored, 0644); err != nil {
+		t.Fatalf("Failed to write stored file: %v", err)
+	}
+
+	err = gitstylebackup.Restore(cfg, "latest", filepath.Join(tempDir, "restore"))
+	if code := exitCode(err); code != 5 {
+		t.Errorf("Expected exit code 5 for a damaged file, got %d: %v", code, err)
+	}
+}
@@ -27,15 +27,16 @@ import (
 	"crypto/sha256"
 	"encoding/json"
 	"errors"
-	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -43,38 +44,9 @@ func init() {
 	// GOMAXPROCS is now set in main.go based on the Priority config setting
 }
 
-var usageStr = `
-Backup Options:
--b, --backup                Use to backup using config file
--t, --trim <version>        Use to trim backup directory to version's specified
-           <+x>             Use to trim backup directory to keep current + x version's specified
--v, --verify <version>      Use to verify files in backup directory current version is 0 
--c, --config <file>         Use to specify the config file used (default: config.txt)
-    --exampleconfig <file>  Use to make an example config file
-    --fix                   Use to fix interrupted backup or trim
-    --fixinuse              Use to remove inuse flag from backup
-
-Common Options:
--h, --help                  Show this help
-    --version               Show version
-
-Notes:
-case is important when defining paths in the config file
-
-Exit Codes:
-     0 = Clean
-    -1 = Version or help
-     1 = Error
-`
-
 const timeFormat = "01/02/2006 15:04:05 -0700"
 const fileNewLine = "\r\n"
 
-func usage() {
-	fmt.Printf("%s\n", usageStr)
-	os.Exit(-1)
-}
-
 // Config holds the backup configuration
 type Config struct {
 	BackupDir         string   `json:"backupDir"`
@@ -84,296 +56,133 @@ type Config struct {
 	EncryptPassword   string   `json:"encryptPassword,omitempty"`   // Optional encryption password
 	EncryptKeyFile    string   `json:"encryptKeyFile,omitempty"`    // Optional encryption key file path
 	RestoreStageDir   string   `json:"restoreStageDir,omitempty"`   // Optional staging directory for restore
-	trimValue         string   `json:"-"`
-	verifyValue       string   `json:"-"`
+	RehashDays        int      `json:"rehashDays,omitempty"`        // Optional, read every file again when the last full rehash is older than this
+	ChunkSizeKB       int      `json:"chunkSizeKB,omitempty"`       // Optional average chunk size, large files are stored in content defined chunks
+	ShardDepth        int      `json:"shardDepth,omitempty"`        // Optional folder levels for stored files in a new backup directory, default 1
+	Source            string   `json:"source,omitempty"`            // Optional name of the versions of this machine in a shared backup directory, default the host name
+	KeyCost           int      `json:"keyCost,omitempty"`           // Optional scrypt cost of new keys of an encrypted backup directory, log2 of n, default 15
+
+	FullRehash bool     `json:"-"` // read every file in this backup instead of reusing unchanged hashes
+	Message    string   `json:"-"` // message recorded in the version written by a backup
+	Tags       []string `json:"-"` // tags recorded in the version written by a backup
 }
 
-var dbBackupFolder = ""
-var dbBackupVersionFolder = ""
-var dbBackupFilesFolder = ""
-var dbBackupInUseFile = ""
-
-func main() {
-	var showHelp bool
-	flag.BoolVar(&showHelp, "h", false, "")
-	flag.BoolVar(&showHelp, "help", false, "")
-
-	var showVersion bool
-	flag.BoolVar(&showVersion, "version", false, "")
-
-	var configFilePath string
-	flag.StringVar(&configFilePath, "c", "./config.txt", "")
-	flag.StringVar(&configFilePath, "config", "./config.txt", "")
-
-	var exampleConfig string
-	flag.StringVar(&exampleConfig, "exampleconfig", "", "")
-
-	var runBackup bool
-	flag.BoolVar(&runBackup, "b", false, "")
-	flag.BoolVar(&runBackup, "backup", false, "")
-
-	var runTrim bool
-	var trimVersionArg = ""
-	flag.StringVar(&trimVersionArg, "t", "", "")
-	flag.StringVar(&trimVersionArg, "trim", "", "")
-
-	var runFix bool
-	flag.BoolVar(&runFix, "fix", false, "")
-
-	var runFixInuse bool
-	flag.BoolVar(&runFixInuse, "fixinuse", false, "")
-
-	var runVerify bool
-	var verifyVersionArg = ""
-	flag.StringVar(&verifyVersionArg, "v", "", "")
-	flag.StringVar(&verifyVersionArg, "verify", "", "")
-
-	flag.Usage = usage
-	flag.Parse()
-
-	if trimVersionArg != "" {
-		runTrim = true
-	}
-
-	if verifyVersionArg != "" {
-		runVerify = true
-	}
-
-	if showHelp {
-		usage()
-	}
-
-	if showVersion {
-		fmt.Println("Version 1.3")
-		os.Exit(-1)
-	}
-
-	var iCheckArgs = 0
-	if runBackup {
-		iCheckArgs++
-	}
-	if runTrim {
-		iCheckArgs++
-	}
-	if runFix {
-		iCheckArgs++
-	}
-	if runFixInuse {
-		iCheckArgs++
-	}
-	if runVerify {
-		iCheckArgs++
-	}
-	if exampleConfig != "" {
-		iCheckArgs++
-	}
-	if iCheckArgs > 1 {
-		fmt.Println("You Cant Use All Arguments At The Same Time")
-		usage()
-	}
-	if iCheckArgs == 0 {
-		usage()
-	}
-
-	if exampleConfig != "" {
-		var eConfig = Config{}
-		eConfig.BackupDir = "C:\\Temp"
-		eConfig.Include = append(eConfig.Include, "C:\\Users")
-		eConfig.Include = append(eConfig.Include, "C:\\ProgramData")
-		eConfig.Exclude = append(eConfig.Exclude, "C:\\Users\\Default")
+// walkedFile is a file found by the backup walker
+type walkedFile struct {
+	path string
+	info os.FileInfo
+}
 
-		if err := WriteConfig(exampleConfig, eConfig); err != nil {
-			fmt.Println("Error Writing Example Config File: " + err.Error())
-			os.Exit(1)
+// backupFiles walks the include paths and writes a new version.
+// The caller must hold the repository lock.
+func (r *Repository) backupFiles(cfg Config) error {
+	for _, tag := range cfg.Tags {
+		if err := checkTagName(tag); err != nil {
+			return err
 		}
-
-		os.Exit(0)
-	}
-
-	cfg, err := ReadConfig(configFilePath)
-	if err != nil {
-		fmt.Println("Error Reading Config File: " + err.Error())
-		os.Exit(1)
 	}
 
-	dbBackupFolder = strings.TrimRight(cfg.BackupDir, "\\")
-	dbBackupVersionFolder = dbBackupFolder + "\\Version"
-	dbBackupFilesFolder = dbBackupFolder + "\\Files"
-	dbBackupInUseFile = dbBackupFolder + "\\InUse.txt"
-
-	//check if backup dir in use
-	exists, err := FileExists(dbBackupInUseFile)
-	if exists || err != nil {
-		if err != nil {
-			fmt.Println("In Use File Exists " + err.Error())
-			os.Exit(1)
-		} else {
-			fmt.Println("In Use File Exists ")
-			os.Exit(1)
-		}
+	if err := r.cleanTempVersions(); err != nil {
+		return err
 	}
 
-	//mark backup folder in use
-	err = WriteByteSliceToFile(dbBackupInUseFile, []byte{})
+	//the previous version is the newest of this source, the new one sorts after every source's
+	dbPrevVersion, err := r.latestSourceVersion()
 	if err != nil {
-		fmt.Println("Writeing In Use File " + err.Error())
-		os.Exit(1)
-	}
-
-	if runBackup {
-		BackupFiles(cfg)
-	}
-
-	if runTrim {
-		cfg.trimValue = trimVersionArg
-		TrimFiles(cfg)
-	}
-
-	if runFix {
-		FixFiles(cfg)
-	}
-
-	if runFixInuse {
-		FixFileInUse(cfg)
-	}
-
-	if runVerify {
-		cfg.verifyValue = verifyVersionArg
-		VerifyFiles(cfg)
+		return err
 	}
-
-	//remove in use file
-	err = FileDelete(dbBackupInUseFile)
+	dbLatestVersion, err := r.latestVersion()
 	if err != nil {
-		fmt.Println("Deleting In Use File " + err.Error())
-		os.Exit(1)
+		return err
 	}
-}
 
-func BackupFiles(cfg Config) error {
-	// Get encryption key if configured
-	encryptionKey, err := getEncryptionKey(cfg)
+	now := time.Now()
+	dbNewVersion, err := newVersionID(now, dbLatestVersion)
 	if err != nil {
-		return fmt.Errorf("error getting encryption key: %v", err)
-	}
-	
-	//make sure dir is setup
-	exists, err := FolderExists(dbBackupVersionFolder)
-	if exists == false && err == nil {
-		err = MakeDir(dbBackupVersionFolder)
-		if err != nil {
-			return fmt.Errorf("error making version folder: %v", err)
-		}
+		return err
 	}
-
-	exists, err = FolderExists(dbBackupFilesFolder)
-	if exists == false && err == nil {
-		err = MakeDir(dbBackupFilesFolder)
-		if err != nil {
-			return fmt.Errorf("error making files folder: %v", err)
-		}
-
-		for i := 0; i <= 25; i++ {
-			err = MakeDir(dbBackupFilesFolder + "\\" + fmt.Sprintf("%02d", i))
-			if err != nil {
-				return fmt.Errorf("error making subfiles folder: %v", err)
-			}
-		}
+	if err := r.checkTagsFree(dbNewVersion, cfg.Tags); err != nil {
+		return err
 	}
 
-	//find max version number
-	var dbNewVersionNumber = 0
-	verDirFile, err := ioutil.ReadDir(dbBackupVersionFolder)
-	if err != nil {
-		return fmt.Errorf("error reading version files: %v", err)
-	}
-	for _, verDF := range verDirFile {
-		if verDF.IsDir() == false {
-			if strings.HasSuffix(verDF.Name(), ".tmp") {
-				err = FileDelete(dbBackupVersionFolder + "\\" + verDF.Name())
-				if err != nil {
-					return fmt.Errorf("error cleaning up temp version %s: %v", verDF.Name(), err)
-				}
-			} else {
-				testVer, err := strconv.Atoi(verDF.Name())
-				if err != nil {
-					return fmt.Errorf("error parsing version file: %v", err)
-				}
+	var dbBackupNewVersionFile = r.versionFile(dbNewVersion)
+	var dbBackupNewTempVersionFile = dbBackupNewVersionFile + tempFileSuffix
 
-				if dbNewVersionNumber < testVer {
-					dbNewVersionNumber = testVer
-				}
-			}
-		}
+	//all workers hand their records to a single collector
+	cache, fullHash := r.loadChangeCache(cfg, dbPrevVersion, now)
+	header := ManifestHeader{
+		Version:    dbNewVersion,
+		Date:       now,
+		FullHash:   fullHash,
+		Parent:     dbPrevVersion,
+		Host:       hostName(),
+		Source:     r.source(),
+		User:       userName(),
+		Program:    ProgramVersion,
+		ConfigHash: configHash(r.cfg),
+		Includes:   cfg.Include,
+		Message:    cfg.Message,
+		Tags:       cfg.Tags,
 	}
+	manifest := newManifestCollector()
 
-	dbNewVersionNumber = dbNewVersionNumber + 1
-
-	var dbBackupNewVersionFile = dbBackupVersionFolder + "\\" + strconv.Itoa(dbNewVersionNumber)
-	var dbBackupNewTempVersionFile = dbBackupNewVersionFile + ".tmp"
+	//counted by the workers, the walker's errors are read once it is done
+	var newBlobs, storeErrors int64
+	var walkErrors int
 
-	//open version file
-	verFile, err := os.OpenFile(dbBackupNewTempVersionFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("error opening version file: %v", err)
-	}
-	defer verFile.Close()
-
-	_, err = verFile.WriteString("VERSION:" + strconv.Itoa(dbNewVersionNumber) + fileNewLine +
-		"DATE:" + time.Now().Format(timeFormat) + fileNewLine)
-	if err != nil {
-		return fmt.Errorf("error writing version file: %v", err)
-	}
+	walkedFiles := make(chan walkedFile)
 
-	walkedFiles := make(chan string)
+	//folders are only recorded by the walker and read once the workers are done
+	var walkedDirs []walkedFile
 
 	// Normalize exclusion paths for better comparison
 	normalizedExcludes := make([]string, len(cfg.Exclude))
 	for i, path := range cfg.Exclude {
-		normalizedExcludes[i] = strings.ToLower(filepath.Clean(path))
+		normalizedExcludes[i] = comparePath(path)
 	}
 
-	go func(t_walkFilePaths []string, t_walkFilePathsExclude []string, t_walkedFilesChan chan string) {
+	go func(t_walkFilePaths []string, t_walkFilePathsExclude []string, t_walkedFilesChan chan walkedFile) {
 		for _, cd := range t_walkFilePaths {
-			errc := filepath.Walk(cd, func(path string, info os.FileInfo, err error) error {
+			// a trailing separator would make the walked folder differ from its include path
+			errc := filepath.Walk(filepath.Clean(cd), func(path string, info os.FileInfo, err error) error {
 				if err != nil {
+					walkErrors++
 					fmt.Printf("Error accessing path %s: %v\n", path, err)
-					return filepath.SkipDir // Skip this directory but continue walking
+					if info != nil && info.IsDir() {
+						return filepath.SkipDir // Skip this directory but continue walking
+					}
+					return nil
+				}
+
+				// Check exclusions, skipping whole directories when they are excluded
+				if isExcluded(path, t_walkFilePathsExclude) {
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
 				}
 
-				// Skip symlinks and non-regular files
+				// Skip symlinks and non-regular files, Walk does not follow symlinks
 				if info.Mode()&os.ModeSymlink != 0 {
 					fmt.Printf("Skipping symlink: %s\n", path)
-					return filepath.SkipDir
+					return nil
 				}
 
-				if !info.Mode().IsRegular() {
+				if info.IsDir() {
+					walkedDirs = append(walkedDirs, walkedFile{path: path, info: info})
 					return nil
 				}
 
-				// Normalize the current path for comparison
-				normalizedPath := strings.ToLower(filepath.Clean(path))
-
-				// Check exclusions
-				for _, ex := range t_walkFilePathsExclude {
-					normalizedEx := strings.ToLower(filepath.Clean(ex))
-
-					// Skip if the path is exactly the excluded path
-					if normalizedPath == normalizedEx {
-						return filepath.SkipDir
-					}
-
-					// Skip if the path is a subdirectory of the excluded path
-					if strings.HasPrefix(normalizedPath, normalizedEx+string(filepath.Separator)) {
-						return filepath.SkipDir
-					}
+				if !info.Mode().IsRegular() {
+					return nil
 				}
 
-				t_walkedFilesChan <- path
+				t_walkedFilesChan <- walkedFile{path: path, info: info}
 				return nil
 			})
 
 			if errc != nil {
+				walkErrors++
 				fmt.Printf("Warning: Error walking path %s: %v\n", cd, errc)
 				// Continue with next path instead of exiting
 			}
@@ -386,38 +195,34 @@ func BackupFiles(cfg Config) error {
 	wg.Add(20)
 	for i := 0; i < 20; i++ {
 		go func() {
-			for path := range walkedFiles {
-				hash, err := HashFile(path)
-				if err != nil {
-					fmt.Printf("Warning: Error hashing file %s: %v\n", path, err)
-					continue // Skip this file but continue processing
+			for file := range walkedFiles {
+				path := file.path
+
+				// reuse the hash of files that did not change since the previous version
+				if entry, ok := cache.lookup(path, file.info); ok && r.blobsExist(entry.Blobs()) {
+					fmt.Println("UNCHANGED FILE:" + path + " -> " + entry.Hash)
+					manifest.Add(entry)
+					continue
 				}
 
-				sFileHash := HashToString(hash)
-
-				_, err = verFile.WriteString("FILE:" + path + fileNewLine +
-					"MODDATE:" + GetFileModifiedDate(path).Format(timeFormat) + fileNewLine +
-					"SIZE:" + strconv.FormatFloat(GetFileSize(path), 'f', 6, 64) + fileNewLine +
-					"HASH:" + sFileHash + fileNewLine)
+				entry, stored, err := r.storeFile(path)
 				if err != nil {
-					fmt.Printf("Warning: Error writing to version file for %s: %v\n", path, err)
-					continue // Skip this file but continue processing
+					atomic.AddInt64(&storeErrors, 1)
+					fmt.Printf("Warning: Error storing file %s: %v\n", path, err)
+					continue // Leave the file out of the version
 				}
 
-				exists, err := FileExists(dbBackupFilesFolder + "\\" + sFileHash[:2] + "\\" + sFileHash)
-				if exists == false && err == nil {
-					fmt.Println("COPYING FILE:" + path + " -> " + sFileHash)
-					err := CopyFileAndGZipWithEncryption(path, dbBackupFilesFolder+"\\"+sFileHash[:2]+"\\"+sFileHash, encryptionKey)
-					if err != nil {
-						fmt.Printf("Warning: Error copying file %s: %v\n", path, err)
-						// Continue processing other files
-					}
-				} else if exists && err == nil {
-					fmt.Println("SKIP FILE COPY:" + path + " -> " + sFileHash)
+				atomic.AddInt64(&newBlobs, int64(stored))
+				if stored > 0 {
+					fmt.Println("COPYING FILE:" + path + " -> " + entry.Hash)
 				} else {
-					fmt.Printf("Warning: Error checking file existence %s: %v\n", path, err)
-					// Continue processing other files
+					fmt.Println("SKIP FILE COPY:" + path + " -> " + entry.Hash)
 				}
+				if entry.Changed {
+					fmt.Printf("Warning: File changed while it was backed up: %s\n", path)
+				}
+
+				manifest.Add(entry)
 			}
 
 			wg.Done()
@@ -425,363 +230,351 @@ func BackupFiles(cfg Config) error {
 	}
 
 	wg.Wait()
+	manifest.Close()
+
+	//store a tree for every folder, folders that did not change get the tree they already have
+	for _, include := range cfg.Include {
+		root, top := buildTree(include, walkedDirs, manifest.Entries())
+		if top == nil {
+			fmt.Printf("Warning: Nothing backed up from %s\n", include)
+			continue
+		}
+		tree, stored, err := r.storeTree(top)
+		if err != nil {
+			return fmt.Errorf("error storing folder tree of %s: %v", include, err)
+		}
+		newBlobs += int64(stored)
+		header.Roots = append(header.Roots, ManifestRoot{Path: root, Tree: tree})
+	}
 
-	// Make sure to close the file before renaming
-	verFile.Close()
+	header.Totals = VersionTotals{NewBlobs: int(newBlobs), Errors: int(storeErrors) + walkErrors}
+	for _, e := range manifest.Entries() {
+		header.Totals.Files++
+		header.Totals.Bytes += e.Size
+	}
+
+	//packs must be complete before a version references them
+	if err := r.packs.flush(); err != nil {
+		return err
+	}
+
+	if err := writeVersionFile(dbBackupNewTempVersionFile, r.key, header, nil); err != nil {
+		return err
+	}
 
 	err = os.Rename(dbBackupNewTempVersionFile, dbBackupNewVersionFile)
 	if err != nil {
 		return fmt.Errorf("error renaming version file: %v", err)
 	}
 
-	return nil
+	return syncDir(r.versionDir)
 }
 
-func TrimFiles(cfg Config) {
+// TrimResult summarizes what a trim operation removed from the backup directory
+type TrimResult struct {
+	TrimVersion       string // versions before this one were removed
+	VersionsRemoved   int    // number of version files deleted
+	VersionsProtected int    // versions before TrimVersion kept for their tags or pin
+	BlobsRemoved      int    // number of file blobs deleted
+	BytesReclaimed    int64  // bytes freed by deleted blobs and version files
+}
 
-	exists, err := FolderExists(dbBackupVersionFolder)
-	if exists == false || err != nil {
-		if err != nil {
-			fmt.Println("No Version Folder Found " + err.Error())
-			os.Exit(1)
-		} else {
-			fmt.Println("No Version Folder Found")
-			os.Exit(1)
+// parseTrimValue converts a trim argument into the oldest version to keep.
+// "+x" keeps the newest x of versions in addition to the current one. A plain
+// number keeps the numbered versions from that number and every named version,
+// it is refused when all versions are named since it could not trim any, "0"
+// keeps everything. Any other version selector is passed to resolve, the
+// selected version and newer are kept. Without resolve selectors are returned
+// as they are.
+func parseTrimValue(trimValue string, versions []string, resolve func(string) (string, error)) (string, error) {
+	value := strings.TrimSpace(trimValue)
+	relative := strings.HasPrefix(value, "+")
+	if relative {
+		value = value[1:]
+	}
+
+	num, err := strconv.Atoi(value)
+	if err != nil {
+		if relative || value == "" {
+			return "", fmt.Errorf("invalid trim version %q: %v", trimValue, err)
+		}
+		if resolve == nil {
+			return value, nil
 		}
+		return resolve(value)
+	}
+	if num < 0 {
+		return "", fmt.Errorf("invalid trim version %q: must not be negative", trimValue)
 	}
 
-	exists, err = FolderExists(dbBackupFilesFolder)
-	if exists == false || err != nil {
-		if err != nil {
-			fmt.Println("No Files Folder Found " + err.Error())
-			os.Exit(1)
-		} else {
-			fmt.Println("No Files Folder Found")
-			os.Exit(1)
+	if !relative {
+		if num > 0 && len(versions) > 0 && !hasNumberedVersion(versions) {
+			return "", fmt.Errorf("invalid trim version %q: numbers only trim versions made by older releases and all versions are named, trim to +x, a version name or a date instead", trimValue)
 		}
+		return strconv.Itoa(num), nil
+	}
+	if num < len(versions) {
+		return versions[len(versions)-1-num], nil
 	}
+	return "0", nil
+}
 
-	//find max version number
-	var dbMaxVersionNumber = 0
-	verDirFile, err := ioutil.ReadDir(dbBackupVersionFolder)
-	if err != nil {
-		fmt.Println("Error Reading Version Files " + err.Error())
-		os.Exit(1)
+// trimFiles removes versions below the trim value and the files only they reference.
+// The caller must hold the repository lock.
+func (r *Repository) trimFiles(trimValue string) (TrimResult, error) {
+	var result TrimResult
+
+	if err := r.cleanTempVersions(); err != nil {
+		return result, err
 	}
-	for _, verDF := range verDirFile {
-		if verDF.IsDir() == false {
-			if strings.HasSuffix(verDF.Name(), ".tmp") {
-				err = FileDelete(dbBackupVersionFolder + "\\" + verDF.Name())
-				if err != nil {
-					fmt.Println("Error Cleaning Up Temp Version " + verDF.Name() + " " + err.Error())
-					os.Exit(1)
-				}
-			} else {
-				testVer, err := strconv.Atoi(verDF.Name())
-				if err != nil {
-					fmt.Println("Error Parsing Version File " + err.Error())
-					os.Exit(1)
-				}
 
-				if dbMaxVersionNumber < testVer {
-					dbMaxVersionNumber = testVer
-				}
-			}
+	headers, err := r.ListAllVersions()
+	if err != nil {
+		return result, err
+	}
+	source := r.source()
+	var sourceVersions []string
+	for _, header := range headers {
+		if header.inSource(source) {
+			sourceVersions = append(sourceVersions, header.Version)
 		}
 	}
 
 	//find what version to trim to
-	trimVersion, err := strconv.Atoi(cfg.trimValue)
+	trimVersion, err := parseTrimValue(trimValue, sourceVersions, r.resolveVersion)
 	if err != nil {
-		fmt.Println("Error Parsing Trim Version")
-		os.Exit(1)
-	}
-
-	if strings.Contains(cfg.trimValue, "+") {
-		trimVersion = dbMaxVersionNumber - trimVersion
-	}
-	if trimVersion < 0 {
-		trimVersion = 0
+		return result, err
 	}
+	result.TrimVersion = trimVersion
 
-	fmt.Println("Trimming To Version ", trimVersion)
+	fmt.Println("Trimming "+source+" To Version ", trimVersion)
 
-	verFiles, err := ioutil.ReadDir(dbBackupVersionFolder)
-	if err != nil {
-		fmt.Println("Error Reading Version Folder " + err.Error())
-		os.Exit(1)
+	//versions of other sources, tagged and pinned versions are kept whatever their number
+	var trimmed, kept []string
+	for _, header := range headers {
+		ver := header.Version
+		if compareVersions(ver, trimVersion) >= 0 || !header.inSource(source) {
+			kept = append(kept, ver)
+			continue
+		}
+		if header.protected() {
+			fmt.Println("Keeping Tagged Version ", ver)
+			kept = append(kept, ver)
+			result.VersionsProtected++
+			continue
+		}
+		trimmed = append(trimmed, ver)
 	}
 
+	//collect hashes of trimmed versions, then drop the ones still used by kept versions
 	var toDel = map[string]bool{}
-	for _, verDF := range verFiles {
-		fmt.Println("Loading Version File " + verDF.Name())
-		testVer, err := strconv.Atoi(verDF.Name())
+	seen := map[string]bool{}
+	for _, ver := range trimmed {
+		fmt.Println("Loading Version File " + ver)
+		err := r.versionBlobs(ver, seen, func(hash string) { toDel[hash] = true })
 		if err != nil {
-			fmt.Println("Error Parsing Version File " + err.Error())
-			os.Exit(1)
+			return result, fmt.Errorf("error reading version file %s: %w", ver, err)
 		}
-		if testVer < trimVersion {
-			verFile, err := os.Open(dbBackupVersionFolder + "\\" + verDF.Name())
-			if err != nil {
-				fmt.Println("Error Opening Version File " + verDF.Name() + " " + err.Error())
-				os.Exit(1)
-			}
-
-			var verFileHash = ""
-			scanner := bufio.NewScanner(verFile)
-			for scanner.Scan() {
-				verFileHash = scanner.Text()
-				if strings.HasPrefix(verFileHash, "HASH:") {
-					fmt.Println("Adding File Hash " + verFileHash[5:])
-					toDel[verFileHash[5:]] = true
-				}
-			}
+	}
 
-			verFile.Close()
+	seen = map[string]bool{}
+	for _, ver := range kept {
+		fmt.Println("Comparing To Version File " + ver)
+		err := r.versionBlobs(ver, seen, func(hash string) { delete(toDel, hash) })
+		if err != nil {
+			return result, fmt.Errorf("error reading version file %s: %w", ver, err)
 		}
 	}
 
-	for _, verDF := range verFiles {
-		fmt.Println("Comparing To Version File " + verDF.Name())
-		testVer, err := strconv.Atoi(verDF.Name())
+	//delete version files first so an interrupted trim never leaves a version without its files
+	for _, ver := range trimmed {
+		verPath := r.versionFile(ver)
+		info, err := os.Stat(verPath)
 		if err != nil {
-			fmt.Println("Error Parsing Version File " + err.Error())
-			os.Exit(1)
+			return result, fmt.Errorf("error reading version file %s: %w", ver, err)
 		}
-		if testVer >= trimVersion {
-			verFile, err := os.Open(dbBackupVersionFolder + "\\" + verDF.Name())
-			if err != nil {
-				fmt.Println("Error Opening Version File " + verDF.Name() + " " + err.Error())
-				os.Exit(1)
-			}
-
-			var verFileHash = ""
-			scanner := bufio.NewScanner(verFile)
-			for scanner.Scan() {
-				verFileHash = scanner.Text()
-				if strings.HasPrefix(verFileHash, "HASH:") {
-					fmt.Println("Removeing File Hash " + verFileHash[5:])
-					toDel[verFileHash[5:]] = false
-				}
-			}
-
-			verFile.Close()
+		fmt.Println("Deleteing Version ", ver)
+		if err := FileDelete(verPath); err != nil {
+			return result, fmt.Errorf("error deleting version file %s: %v", ver, err)
 		}
+		result.VersionsRemoved++
+		result.BytesReclaimed += info.Size()
 	}
 
 	//delete files from disk
-	for key, val := range toDel {
-		if val == true {
-			fmt.Println("Deleting File " + key)
-			err := FileDelete(dbBackupFilesFolder + "\\" + key[:2] + "\\" + key)
-			if err != nil {
-				fmt.Println("Error Deleting File " + key + " " + err.Error())
+	for key := range toDel {
+		blobPath := r.blobFile(key)
+		info, err := os.Stat(blobPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
 			}
+			return result, fmt.Errorf("error reading file %s: %v", key, err)
 		}
+		fmt.Println("Deleting File " + key)
+		if err := FileDelete(blobPath); err != nil {
+			return result, fmt.Errorf("error deleting file %s: %v", key, err)
+		}
+		result.BlobsRemoved++
+		result.BytesReclaimed += info.Size()
 	}
 
-	//delete version file from disk
-	for ver := 1; ver < trimVersion; ver++ {
-		exists, err = FileExists(dbBackupVersionFolder + "\\" + strconv.Itoa(ver))
-		if exists && err == nil {
-			fmt.Println("Deleteing Version ", ver)
-			err = FileDelete(dbBackupVersionFolder + "\\" + strconv.Itoa(ver))
-			if err != nil {
-				fmt.Println("Error Deleteing Versin File " + strconv.Itoa(ver) + " " + err.Error())
-			}
-		} else if err != nil {
-			fmt.Println("Error Deleteing Version File " + strconv.Itoa(ver) + " " + err.Error())
-		}
+	//rewrite packs holding deleted files
+	removed, reclaimed, err := r.packs.repack(func(hash string) bool { return !toDel[hash] })
+	result.BlobsRemoved += removed
+	result.BytesReclaimed += reclaimed
+	if err != nil {
+		return result, err
 	}
 
-	return
+	return result, nil
 }
 
-func VerifyFiles(cfg Config) {
+// VerifyIssue describes a single file that failed verification
+type VerifyIssue struct {
+	Path   string // original path of the file recorded in the version
+	Hash   string // hash the version expects for the file
+	Actual string // hash of the stored content when it does not match
+	Err    string // error detail when the stored file is missing or unreadable
+}
 
-	exists, err := FolderExists(dbBackupVersionFolder)
-	if exists == false || err != nil {
-		if err != nil {
-			fmt.Println("No Version Folder Found " + err.Error())
-			os.Exit(1)
-		} else {
-			fmt.Println("No Version Folder Found")
-			os.Exit(1)
-		}
+// VerifyReport lists the results of verifying a backup version
+type VerifyReport struct {
+	Version         string
+	FilesChecked    int
+	MissingBlobs    []VerifyIssue
+	UnreadableBlobs []VerifyIssue
+	HashMismatches  []VerifyIssue
+}
+
+// OK reports whether the version verified without any problems
+func (r VerifyReport) OK() bool {
+	return len(r.MissingBlobs) == 0 && len(r.UnreadableBlobs) == 0 && len(r.HashMismatches) == 0
+}
+
+// Err returns an error wrapping ErrBlobMissing and/or ErrBlobCorrupt
+// for the problems in the report, nil when the version verified
+func (r VerifyReport) Err() error {
+	if r.OK() {
+		return nil
 	}
 
-	exists, err = FolderExists(dbBackupFilesFolder)
-	if exists == false || err != nil {
-		if err != nil {
-			fmt.Println("No Files Folder Found " + err.Error())
-			os.Exit(1)
-		} else {
-			fmt.Println("No Files Folder Found")
-			os.Exit(1)
-		}
+	var errs []error
+	if len(r.MissingBlobs) > 0 {
+		errs = append(errs, fmt.Errorf("%w: %d files", ErrBlobMissing, len(r.MissingBlobs)))
 	}
+	if len(r.UnreadableBlobs)+len(r.HashMismatches) > 0 {
+		errs = append(errs, fmt.Errorf("%w: %d files", ErrBlobCorrupt, len(r.UnreadableBlobs)+len(r.HashMismatches)))
+	}
+	return fmt.Errorf("version %s failed verification: %w", r.Version, errors.Join(errs...))
+}
 
-	//find what version to verify
-	var verifyVersion = 0
-	if cfg.verifyValue == "0" {
-		//find max version number
-		var dbMaxVersionNumber = 0
-		verDirFile, err := ioutil.ReadDir(dbBackupVersionFolder)
-		if err != nil {
-			fmt.Println("Error Reading Version Files " + err.Error())
-			os.Exit(1)
-		}
-		for _, verDF := range verDirFile {
-			if verDF.IsDir() == false {
-				if !strings.HasSuffix(verDF.Name(), ".tmp") {
-					testVer, err := strconv.Atoi(verDF.Name())
-					if err != nil {
-						fmt.Println("Error Parsing Version File " + err.Error())
-						os.Exit(1)
-					}
+// Problems returns the number of files that failed verification
+func (r VerifyReport) Problems() int {
+	return len(r.MissingBlobs) + len(r.UnreadableBlobs) + len(r.HashMismatches)
+}
 
-					if dbMaxVersionNumber < testVer {
-						dbMaxVersionNumber = testVer
-					}
-				}
-			}
-		}
+// verifyFiles checks the stored files of a version against their hashes
+func (r *Repository) verifyFiles(verifyValue string) (VerifyReport, error) {
+	var report VerifyReport
 
-		verifyVersion = dbMaxVersionNumber
-	} else {
-		verifyVersion, err = strconv.Atoi(cfg.verifyValue)
-		if err != nil {
-			fmt.Println("Error Parsing Verify Version")
-			os.Exit(1)
-		}
+	//find what version to verify
+	verifyVersion, err := r.resolveVersion(verifyValue)
+	if err != nil {
+		return report, err
 	}
+	report.Version = verifyVersion
 
 	fmt.Println("Verifying Version ", verifyVersion)
 
-	verFile, err := os.Open(dbBackupVersionFolder + "\\" + strconv.Itoa(verifyVersion))
-	if err != nil {
-		fmt.Println("Error Opening Version File " + strconv.Itoa(verifyVersion) + " " + err.Error())
-		os.Exit(1)
-	}
+	_, err = r.readVersion(verifyVersion, func(e ManifestEntry) error {
+		report.FilesChecked++
+
+		for _, blob := range e.Blobs() {
+			issue := VerifyIssue{Path: e.Path, Hash: blob}
 
-	var verFileHash = ""
-	var bVerifyErrors = false
-	scanner := bufio.NewScanner(verFile)
-	for scanner.Scan() {
-		verFileHash = scanner.Text()
-		if strings.HasPrefix(verFileHash, "HASH:") {
-			newFileHash, err := hashGzipFile(dbBackupFilesFolder + "\\" + verFileHash[5:7] + "\\" + verFileHash[5:])
+			blobPath := r.blobFile(issue.Hash)
+			newFileHash, err := r.hashBlob(issue.Hash)
 			if err != nil {
-				fmt.Println("Error Hashing File " + dbBackupFilesFolder + "\\" + verFileHash[5:7] + "\\" + verFileHash[5:] + " : " + err.Error())
-				bVerifyErrors = true
-			} else {
-				newStringFileHash := HashToString(newFileHash)
-
-				if newStringFileHash != verFileHash[5:] {
-					fmt.Println("File Not Verifyed " + newStringFileHash + "!=" + verFileHash[5:])
-					bVerifyErrors = true
+				issue.Err = err.Error()
+				if os.IsNotExist(err) {
+					fmt.Println("Missing File " + blobPath + " for " + issue.Path)
+					report.MissingBlobs = append(report.MissingBlobs, issue)
+				} else {
+					fmt.Println("Error Hashing File " + blobPath + " : " + err.Error())
+					report.UnreadableBlobs = append(report.UnreadableBlobs, issue)
 				}
+				continue
 			}
-		}
-	}
-
-	verFile.Close()
-
-	if bVerifyErrors == true {
-		os.Exit(1)
-	}
 
-	return
-}
-
-func FixFiles(cfg Config) {
-
-	exists, err := FolderExists(dbBackupVersionFolder)
-	if exists == false || err != nil {
-		if err != nil {
-			fmt.Println("No Version Folder Found " + err.Error())
-			os.Exit(1)
-		} else {
-			fmt.Println("No Version Folder Found")
-			os.Exit(1)
+			issue.Actual = r.hashName(newFileHash)
+			if issue.Actual != issue.Hash {
+				fmt.Println("File Not Verifyed " + issue.Actual + "!=" + issue.Hash)
+				report.HashMismatches = append(report.HashMismatches, issue)
+			}
 		}
-	}
-
-	exists, err = FolderExists(dbBackupFilesFolder)
-	if exists == false || err != nil {
-		if err != nil {
-			fmt.Println("No Files Folder Found " + err.Error())
-			os.Exit(1)
+		return nil
+	}, func(treeErr *BlobError) error {
+		//a folder tree that cannot be read hides everything below it
+		issue := VerifyIssue{Path: treeErr.Path, Hash: treeErr.Hash, Err: treeErr.Err.Error()}
+		fmt.Println("Error Reading Folder " + treeErr.Path + " : " + issue.Err)
+		if errors.Is(treeErr, ErrBlobMissing) {
+			report.MissingBlobs = append(report.MissingBlobs, issue)
 		} else {
-			fmt.Println("No Files Folder Found")
-			os.Exit(1)
+			report.UnreadableBlobs = append(report.UnreadableBlobs, issue)
+		}
+		return nil
+	})
+	if err != nil {
+		if os.IsNotExist(err) {
+			return report, fmt.Errorf("%w: version %s", ErrVersionNotFound, verifyVersion)
 		}
+		return report, fmt.Errorf("error reading version file %s: %w", verifyVersion, err)
 	}
 
-	//find max version number
-	var dbMaxVersionNumber = 0
-	verDirFile, err := ioutil.ReadDir(dbBackupVersionFolder)
-	if err != nil {
-		fmt.Println("Error Reading Version Files " + err.Error())
-		os.Exit(1)
+	if !report.OK() {
+		return report, report.Err()
 	}
-	for _, verDF := range verDirFile {
-		if verDF.IsDir() == false {
-			if strings.HasSuffix(verDF.Name(), ".tmp") {
-				err = FileDelete(dbBackupVersionFolder + "\\" + verDF.Name())
-				if err != nil {
-					fmt.Println("Error Cleaning Up Temp Version " + verDF.Name() + " " + err.Error())
-					os.Exit(1)
-				}
-			} else {
-				testVer, err := strconv.Atoi(verDF.Name())
-				if err != nil {
-					fmt.Println("Error Parsing Version File " + err.Error())
-					os.Exit(1)
-				}
 
-				if dbMaxVersionNumber < testVer {
-					dbMaxVersionNumber = testVer
-				}
-			}
-		}
+	return report, nil
+}
+
+// fixFiles cleans up after an interrupted backup or trim by removing temporary
+// versions and stored files no version references.
+// The caller must hold the repository lock.
+func (r *Repository) fixFiles() error {
+	if err := r.cleanTempVersions(); err != nil {
+		return err
 	}
 
-	//open version file for reading hashes
-	verFiles, err := ioutil.ReadDir(dbBackupVersionFolder)
+	versions, err := r.Versions()
 	if err != nil {
-		fmt.Println("Error Reading Version Folder " + err.Error())
-		os.Exit(1)
+		return err
 	}
 
 	var toKeep = map[string]bool{}
-	for _, verDF := range verFiles {
-		fmt.Println("Loading Versin File " + verDF.Name())
-		verFile, err := os.Open(dbBackupVersionFolder + "\\" + verDF.Name())
+	seen := map[string]bool{}
+	for _, ver := range versions {
+		fmt.Println("Loading Versin File " + ver)
+		err := r.versionBlobs(ver, seen, func(hash string) { toKeep[hash] = true })
 		if err != nil {
-			fmt.Println("Error Opening Version File " + verDF.Name() + " " + err.Error())
-			os.Exit(1)
+			return fmt.Errorf("error reading version file %s: %w", ver, err)
 		}
-
-		var verFileHash = ""
-		scanner := bufio.NewScanner(verFile)
-		for scanner.Scan() {
-			verFileHash = scanner.Text()
-			if strings.HasPrefix(verFileHash, "HASH:") {
-				fmt.Println("Adding File Hash " + verFileHash[5:])
-				toKeep[verFileHash[5:]] = true
-			}
-		}
-		verFile.Close()
 	}
 
-	err = _FixFilesDir(dbBackupFilesFolder, toKeep)
+	err = _FixFilesDir(r.filesDir, toKeep)
 	if err != nil {
-		fmt.Println("Error Fixing Files " + err.Error())
-		os.Exit(1)
+		return fmt.Errorf("error fixing files: %v", err)
+	}
+
+	if err := r.packs.clean(); err != nil {
+		return fmt.Errorf("error fixing packs: %v", err)
+	}
+	if _, _, err := r.packs.repack(func(hash string) bool { return toKeep[hash] }); err != nil {
+		return fmt.Errorf("error fixing packs: %v", err)
 	}
 
-	return
+	return nil
 }
 
 func _FixFilesDir(dir string, toKeep map[string]bool) error {
@@ -793,7 +586,13 @@ func _FixFilesDir(dir string, toKeep map[string]bool) error {
 
 	for _, df := range dirFiles {
 		if df.IsDir() {
-			err := _FixFilesDir(dir+"\\"+df.Name(), toKeep)
+			err := _FixFilesDir(filepath.Join(dir, df.Name()), toKeep)
+			if err != nil {
+				return err
+			}
+		} else if strings.HasSuffix(df.Name(), tempFileSuffix) {
+			fmt.Println("Deleteing Temp File " + df.Name())
+			err = FileDelete(filepath.Join(dir, df.Name()))
 			if err != nil {
 				return err
 			}
@@ -801,7 +600,7 @@ func _FixFilesDir(dir string, toKeep map[string]bool) error {
 			fmt.Println("Checking File " + df.Name())
 			if toKeep[df.Name()] == false {
 				fmt.Println("Deleteing File " + df.Name())
-				err = FileDelete(dir + "\\" + df.Name())
+				err = FileDelete(filepath.Join(dir, df.Name()))
 				if err != nil {
 					return err
 				}
@@ -812,14 +611,25 @@ func _FixFilesDir(dir string, toKeep map[string]bool) error {
 	return nil
 }
 
-func FixFileInUse(cfg Config) {
-	//remove the inuse file
-	err := FileDelete(dbBackupInUseFile)
-	if err != nil {
-		fmt.Println("Error Removing In Use File " + err.Error())
-		os.Exit(1)
-	}
-	return
+// BackupFiles makes a new version of the included files.
+//
+// Deprecated: use Backup, or Repository.Backup.
+func BackupFiles(cfg Config) error {
+	return Backup(cfg)
+}
+
+// FixFiles removes stored files no version references.
+//
+// Deprecated: use Fix, or Repository.Fix.
+func FixFiles(cfg Config) error {
+	return Fix(cfg)
+}
+
+// FixFileInUse removes the in-use mark of a backup directory.
+//
+// Deprecated: use FixInUse, or Repository.FixInUse.
+func FixFileInUse(cfg Config) error {
+	return FixInUse(cfg)
 }
 
 func ReadConfig(path string) (Config, error) {
@@ -856,26 +666,95 @@ func WriteConfig(path string, cfg Config) error {
 	return nil
 }
 
-func hashGzipFile(path string) ([]byte, error) {
-	hasher := sha1.New()
+// storedFileReader reads the original content of a stored backup file
+type storedFileReader struct {
+	gz   *gzip.Reader
+	file io.Closer
+}
 
+func (s *storedFileReader) Read(p []byte) (int, error) {
+	return s.gz.Read(p)
+}
+
+func (s *storedFileReader) Close() error {
+	s.gz.Close()
+	return s.file.Close()
+}
+
+// openStoredFile opens a stored backup file for reading its original content,
+// decrypting it first when an encryption key is given
+func openStoredFile(path string, encryptionKey []byte) (io.ReadCloser, error) {
 	file, err := os.Open(path)
 	if err != nil {
-		return []byte{}, err
+		return nil, err
 	}
-	defer file.Close()
+	return newStoredFileReader(file, encryptionKey)
+}
 
-	gz, err := gzip.NewReader(file)
+// newStoredFileReader reads the original content of the stored bytes in raw
+// and closes raw when it is closed, also when it fails
+func newStoredFileReader(raw io.ReadCloser, encryptionKey []byte) (io.ReadCloser, error) {
+	compressed, err := decryptStoredFile(bufio.NewReader(raw), encryptionKey)
 	if err != nil {
-		return []byte{}, err
+		raw.Close()
+		return nil, err
 	}
-	defer gz.Close()
 
-	reader := bufio.NewReader(gz)
-	_, err = io.Copy(hasher, reader)
+	gz, err := gzip.NewReader(compressed)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return &storedFileReader{gz: gz, file: raw}, nil
+}
+
+// gzipMagic starts every stored file that is not encrypted
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// decryptStoredFile returns the compressed content of stored bytes, in
+// unchanged when no encryption key is given. An encrypted file without a key,
+// or an unencrypted one with a key, is reported as ErrBlobCorrupt.
+func decryptStoredFile(in *bufio.Reader, encryptionKey []byte) (io.Reader, error) {
+	prefix, _ := in.Peek(len(streamMagic))
+	if encryptionKey == nil {
+		if isStream(prefix) {
+			return nil, fmt.Errorf("%w: file is encrypted in an unencrypted backup directory", ErrBlobCorrupt)
+		}
+		return in, nil
+	}
+	if isStream(prefix) {
+		return newDecryptReader(in, encryptionKey, ErrBlobCorrupt)
+	}
+
+	// files encrypted before streams existed are decrypted at once
+	encryptedData, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	compressedData, err := decryptData(encryptedData, encryptionKey)
+	if err != nil {
+		// a nonce may start like gzip, so this is only looked at once decryption failed
+		if bytes.HasPrefix(encryptedData, gzipMagic) {
+			return nil, fmt.Errorf("%w: file is not encrypted in an encrypted backup directory", ErrBlobCorrupt)
+		}
+		return nil, fmt.Errorf("decryption failed: %w", err)
+	}
+	return bytes.NewReader(compressedData), nil
+}
+
+// hashStoredFile hashes the original content of a stored backup file,
+// decrypting it first when an encryption key is given
+func hashStoredFile(path string, encryptionKey []byte) ([]byte, error) {
+	in, err := openStoredFile(path, encryptionKey)
 	if err != nil {
 		return []byte{}, err
 	}
+	defer in.Close()
+
+	hasher := sha1.New()
+	if _, err = io.Copy(hasher, in); err != nil {
+		return []byte{}, err
+	}
 
 	return hasher.Sum(nil), nil
 }
@@ -998,6 +877,23 @@ func Backup(cfg Config) error {
 		return errors.New("at least one include path is required")
 	}
 
+	r, err := Init(cfg)
+	if err != nil {
+		return err
+	}
+
+	return r.Backup()
+}
+
+// Backup backs up the include paths of the repository config into a new version
+func (r *Repository) Backup() error {
+	cfg := r.cfg
+
+	// Validate config
+	if len(cfg.Include) == 0 {
+		return errors.New("at least one include path is required")
+	}
+
 	// Check if any include paths exist
 	validPath := false
 	for _, path := range cfg.Include {
@@ -1020,55 +916,18 @@ func Backup(cfg Config) error {
 		fmt.Printf("Automatically excluding executable directory: %s\n", exePath)
 	}
 
-	// Setup backup paths
-	dbBackupFolder = strings.TrimRight(cfg.BackupDir, "\\")
-	dbBackupVersionFolder = filepath.Join(dbBackupFolder, "Version")
-	dbBackupFilesFolder = filepath.Join(dbBackupFolder, "Files")
-	dbBackupInUseFile = filepath.Join(dbBackupFolder, "InUse.txt")
-
 	// Automatically add backup folder to exclusions
-	fmt.Printf("Automatically excluding backup directory: %s\n", dbBackupFolder)
-
-	// Create backup directory if it doesn't exist
-	if err := os.MkdirAll(dbBackupFolder, 0755); err != nil {
-		return fmt.Errorf("failed to create backup directory: %v", err)
-	}
-
-	// Create version directory if it doesn't exist
-	if err := os.MkdirAll(dbBackupVersionFolder, 0755); err != nil {
-		return fmt.Errorf("failed to create version directory: %v", err)
-	}
-
-	// Create files directory if it doesn't exist
-	if err := os.MkdirAll(dbBackupFilesFolder, 0755); err != nil {
-		return fmt.Errorf("failed to create files directory: %v", err)
-	}
-
-	// Create subdirectories in files directory
-	for i := 0; i <= 25; i++ {
-		subdir := filepath.Join(dbBackupFilesFolder, fmt.Sprintf("%02d", i))
-		if err := os.MkdirAll(subdir, 0755); err != nil {
-			return fmt.Errorf("failed to create subfiles directory %s: %v", subdir, err)
-		}
-	}
-
-	// Check if backup dir is in use
-	exists, err := FileExists(dbBackupInUseFile)
-	if exists || err != nil {
-		if err != nil {
-			return fmt.Errorf("error checking in-use file: %v", err)
-		}
-		return errors.New("backup directory is in use")
-	}
+	fmt.Printf("Automatically excluding backup directory: %s\n", r.root)
 
 	// Mark backup folder in use
-	if err := WriteByteSliceToFile(dbBackupInUseFile, []byte{}); err != nil {
-		return fmt.Errorf("failed to create in-use file: %v", err)
+	if err := r.Lock(); err != nil {
+		return err
 	}
-	defer FileDelete(dbBackupInUseFile)
+	defer r.Unlock()
 
 	// Create a temporary config with auto-exclusions
 	tempCfg := cfg
+	tempCfg.Exclude = append([]string{}, cfg.Exclude...)
 
 	// Add executable path to exclusions if it's not empty
 	if exePath != "" {
@@ -1076,38 +935,63 @@ func Backup(cfg Config) error {
 	}
 
 	// Add backup folder to exclusions
-	tempCfg.Exclude = append(tempCfg.Exclude, dbBackupFolder)
+	tempCfg.Exclude = append(tempCfg.Exclude, r.root)
 
-	BackupFiles(tempCfg)
-	return nil
+	return r.backupFiles(tempCfg)
 }
 
-// Trim performs a trim operation using the provided configuration and trim value
-func Trim(cfg Config, trimValue string) error {
-	cfg.trimValue = trimValue
+// Trim opens the backup directory of cfg and trims it like Repository.Trim.
+func Trim(cfg Config, trimValue string) (TrimResult, error) {
+	// Validate trim value before touching the backup directory
+	if _, err := parseTrimValue(trimValue, nil, nil); err != nil {
+		return TrimResult{}, err
+	}
 
-	// Validate trim value
-	_, err := strconv.Atoi(trimValue)
+	r, err := Open(cfg)
 	if err != nil {
-		return fmt.Errorf("invalid trim version: %v", err)
+		return TrimResult{}, err
 	}
 
-	return nil
+	return r.Trim(trimValue)
 }
 
-// Verify performs a verify operation using the provided configuration and verify value
-func Verify(cfg Config, verifyValue string) error {
-	cfg.verifyValue = verifyValue
+// Trim removes the versions of this source older than trimValue and the
+// files only they reference. trimValue is "+x" to keep the newest x versions
+// besides the current one, or a version selector: a version id or a unique
+// prefix of it, a tag, latest~n or a date, keeping that version and newer.
+// A plain number keeps the versions numbered by older releases from that
+// number, it is refused when all versions are named, and "0" keeps them all.
+// Tagged and pinned versions and the versions of other sources are always kept.
+func (r *Repository) Trim(trimValue string) (TrimResult, error) {
+	if _, err := parseTrimValue(trimValue, nil, nil); err != nil {
+		return TrimResult{}, err
+	}
 
-	// Validate verify value
-	if verifyValue != "0" {
-		_, err := strconv.Atoi(verifyValue)
-		if err != nil {
-			return fmt.Errorf("invalid verify version: %v", err)
-		}
+	// Mark backup folder in use
+	if err := r.Lock(); err != nil {
+		return TrimResult{}, err
 	}
+	defer r.Unlock()
 
-	return nil
+	return r.trimFiles(trimValue)
+}
+
+// Verify checks the stored files of a backup version against their hashes.
+// verifyValue is the version number or tag to verify, 0 verifies the newest version.
+// The returned report lists every problem found, the error is non-nil when any file failed.
+func Verify(cfg Config, verifyValue string) (VerifyReport, error) {
+	r, err := Open(cfg)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+
+	return r.Verify(verifyValue)
+}
+
+// Verify checks the stored files of a backup version against their hashes.
+// verifyValue is the version number or tag to verify, 0 verifies the newest version.
+func (r *Repository) Verify(verifyValue string) (VerifyReport, error) {
+	return r.verifyFiles(verifyValue)
 }
 
 // GetFileSize returns the size of a file in MB
@@ -1162,7 +1046,9 @@ func CopyFileAndGZip(src, dst string) error {
 	return CopyFileAndGZipWithEncryption(src, dst, nil)
 }
 
-// CopyFileAndGZipWithEncryption copies, compresses, and optionally encrypts a file
+// CopyFileAndGZipWithEncryption copies, compresses, and optionally encrypts a file.
+// The file is written to a temporary name next to dst and renamed once it is
+// complete, so dst never exists with partial content.
 func CopyFileAndGZipWithEncryption(src, dst string, encryptionKey []byte) error {
 	in, err := os.Open(src)
 	if err != nil {
@@ -1170,66 +1056,124 @@ func CopyFileAndGZipWithEncryption(src, dst string, encryptionKey []byte) error
 	}
 	defer in.Close()
 
-	out, err := os.Create(dst)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
+	return writeFileAtomic(dst, func(out io.Writer) error {
+		return gzipAndEncrypt(out, in, encryptionKey)
+	})
+}
 
-	if encryptionKey != nil {
-		// Read all data, compress, then encrypt
-		var compressedData bytes.Buffer
-		gzipWriter := gzip.NewWriter(&compressedData)
-		
-		if _, err = io.Copy(gzipWriter, in); err != nil {
-			return err
-		}
-		
-		if err = gzipWriter.Close(); err != nil {
-			return err
-		}
-		
-		// Encrypt the compressed data
-		encryptedData, err := encryptData(compressedData.Bytes(), encryptionKey)
-		if err != nil {
-			return fmt.Errorf("encryption failed: %v", err)
-		}
-		
-		// Write encrypted data to file
-		if _, err = out.Write(encryptedData); err != nil {
-			return err
-		}
-	} else {
+// gzipAndEncrypt compresses in to out and encrypts it when a key is given
+func gzipAndEncrypt(out io.Writer, in io.Reader, encryptionKey []byte) error {
+	if encryptionKey == nil {
 		// Original behavior: just compress
 		gzipWriter := gzip.NewWriter(out)
-		defer func() {
-			cerr := gzipWriter.Close()
-			if err == nil {
-				err = cerr
-			}
-		}()
-		
-		if _, err = io.Copy(gzipWriter, in); err != nil {
+		if _, err := io.Copy(gzipWriter, in); err != nil {
 			return err
 		}
+		return gzipWriter.Close()
 	}
-	
-	err = out.Sync()
+
+	// Compress and encrypt segment by segment
+	encryptWriter, err := newEncryptWriter(out, encryptionKey)
 	if err != nil {
+		return fmt.Errorf("encryption failed: %v", err)
+	}
+	gzipWriter := gzip.NewWriter(encryptWriter)
+	if _, err := io.Copy(gzipWriter, in); err != nil {
 		return err
 	}
-	return nil
+	if err := gzipWriter.Close(); err != nil {
+		return err
+	}
+	return encryptWriter.Close()
+}
+
+// tempFileSuffix marks files that are still being written. Fix removes
+// the ones left behind by an interrupted backup.
+const tempFileSuffix = ".tmp"
+
+// syncDir syncs the entries of dir, so a file renamed into it is not lost
+// on a power failure. Windows cannot sync a folder, NTFS journals renames.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeFileAtomic writes a file through write to a temporary name in the
+// same folder, syncs it, renames it to path and syncs the folder
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*"+tempFileSuffix)
+	if err != nil {
+		return err
+	}
+
+	err = write(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(path))
 }
 
 // Fix performs a fix operation using the provided configuration
 func Fix(cfg Config) error {
-	FixFiles(cfg)
-	return nil
+	r, err := Open(cfg)
+	if err != nil {
+		return err
+	}
+
+	return r.Fix()
+}
+
+// Fix cleans up after an interrupted backup or trim
+func (r *Repository) Fix() error {
+	// Mark backup folder in use
+	if err := r.Lock(); err != nil {
+		return err
+	}
+	defer r.Unlock()
+
+	return r.fixFiles()
 }
 
 // FixInUse performs a fix in-use operation using the provided configuration
 func FixInUse(cfg Config) error {
-	FixFileInUse(cfg)
+	r, err := newRepository(cfg)
+	if err != nil {
+		return err
+	}
+
+	return r.FixInUse()
+}
+
+// FixInUse removes the in-use mark left behind by an interrupted operation
+func (r *Repository) FixInUse() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	//remove the inuse file
+	if err := FileDelete(r.inUseFile); err != nil {
+		return fmt.Errorf("error removing in-use file: %v", err)
+	}
+	r.locked = false
 	return nil
 }
 
@@ -1293,13 +1237,14 @@ func decryptData(ciphertext []byte, key []byte) ([]byte, error) {
 	
 	nonceSize := gcm.NonceSize()
 	if len(ciphertext) < nonceSize {
-		return nil, errors.New("ciphertext too short")
+		return nil, fmt.Errorf("%w: ciphertext too short", ErrBlobCorrupt)
 	}
 	
 	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
 	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
 	if err != nil {
-		return nil, err
+		// tampered data, or a wrong key while the key is checked
+		return nil, fmt.Errorf("%w: %w", ErrBlobCorrupt, errNotAuthentic)
 	}
 	
 	return plaintext, nil
@@ -1318,9 +1263,12 @@ func getEncryptionKey(cfg Config) ([]byte, error) {
 	return nil, nil // No encryption
 }
 
+// restoreStateFileName is the file in the restore directory that tracks restore progress
+const restoreStateFileName = "restore_state.json"
+
 // RestoreState represents the state of a restore operation
 type RestoreState struct {
-	Version        int      `json:"version"`
+	Version        string   `json:"version"`
 	BackupDir      string   `json:"backupDir"`
 	RestoreDir     string   `json:"restoreDir"`
 	StageDir       string   `json:"stageDir,omitempty"`
@@ -1336,7 +1284,7 @@ type RestoreState struct {
 
 // ExtractGZipAndDecrypt extracts and optionally decrypts a file
 func ExtractGZipAndDecrypt(src, dst string, encryptionKey []byte) error {
-	in, err := os.Open(src)
+	in, err := openStoredFile(src, encryptionKey)
 	if err != nil {
 		return err
 	}
@@ -1348,78 +1296,75 @@ func ExtractGZipAndDecrypt(src, dst string, encryptionKey []byte) error {
 	}
 	defer out.Close()
 
-	if encryptionKey != nil {
-		// Read encrypted data
-		encryptedData, err := ioutil.ReadAll(in)
-		if err != nil {
-			return err
-		}
-		
-		// Decrypt the data
-		compressedData, err := decryptData(encryptedData, encryptionKey)
-		if err != nil {
-			return fmt.Errorf("decryption failed: %v", err)
-		}
-		
-		// Decompress the data
-		gzipReader, err := gzip.NewReader(bytes.NewReader(compressedData))
+	if _, err = io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// extractStagedFile extracts the staged files holding the content of one
+// file to dst, a chunked file is written chunk by chunk
+func extractStagedFile(stageDir string, blobs []string, dst string, encryptionKey []byte) error {
+	if len(blobs) == 1 {
+		return ExtractGZipAndDecrypt(filepath.Join(stageDir, blobs[0]), dst, encryptionKey)
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	for _, blob := range blobs {
+		in, err := openStoredFile(filepath.Join(stageDir, blob), encryptionKey)
 		if err != nil {
 			return err
 		}
-		defer gzipReader.Close()
-		
-		if _, err = io.Copy(out, gzipReader); err != nil {
-			return err
-		}
-	} else {
-		// Original behavior: just decompress
-		gzipReader, err := gzip.NewReader(in)
+		_, err = io.Copy(out, in)
+		in.Close()
 		if err != nil {
 			return err
 		}
-		defer gzipReader.Close()
-		
-		if _, err = io.Copy(out, gzipReader); err != nil {
-			return err
-		}
 	}
-	
-	return nil
+	return out.Close()
 }
 
 // Restore performs a restore operation with resumable two-stage process
 func Restore(cfg Config, version string, restoreDir string) error {
-	// Validate version
-	versionNum, err := strconv.Atoi(version)
+	r, err := Open(cfg)
 	if err != nil {
-		return fmt.Errorf("invalid version number: %v", err)
+		return err
 	}
-	
-	// Setup paths
-	dbBackupFolder = cfg.BackupDir
-	dbBackupVersionFolder = dbBackupFolder + "\\version"
-	dbBackupFilesFolder = dbBackupFolder + "\\files"
-	
-	versionFile := dbBackupVersionFolder + "\\" + version
-	stateFile := restoreDir + "\\restore_state.json"
+
+	return r.Restore(version, restoreDir)
+}
+
+// Restore restores a backup version into restoreDir with a resumable two-stage process
+func (r *Repository) Restore(version string, restoreDir string) error {
+	cfg := r.cfg
+
+	// Find the version by number or tag
+	versionNum, err := r.resolveVersion(version)
+	if err != nil {
+		return err
+	}
+
+	versionFile := r.versionFile(versionNum)
+	stateFile := filepath.Join(restoreDir, restoreStateFileName)
 	
 	// Check if version file exists
 	exists, err := FileExists(versionFile)
 	if !exists || err != nil {
-		return fmt.Errorf("backup version %s not found", version)
+		return fmt.Errorf("%w: version %s", ErrVersionNotFound, version)
 	}
 	
-	// Get encryption key if configured
-	encryptionKey, err := getEncryptionKey(cfg)
-	if err != nil {
-		return fmt.Errorf("error getting encryption key: %v", err)
-	}
+	encryptionKey := r.key
 	
 	// Check for existing restore state
 	var state RestoreState
 	stateExists, _ := FileExists(stateFile)
 	if stateExists {
-		state, err = loadRestoreState(stateFile)
+		state, err = loadRestoreState(stateFile, r.key)
 		if err != nil {
 			fmt.Printf("Warning: Could not load restore state, starting fresh: %v\n", err)
 			stateExists = false
@@ -1464,12 +1409,12 @@ func Restore(cfg Config, version string, restoreDir string) error {
 	// Phase 1: Copy backup files to staging area
 	if state.Phase == "copying" {
 		fmt.Println("Phase 1: Copying backup files...")
-		err = copyBackupFiles(&state, versionFile, encryptionKey)
+		err = r.copyBackupFiles(&state)
 		if err != nil {
-			return err
+			return fmt.Errorf("restore incomplete, could not copy all files: %w", err)
 		}
 		state.Phase = "extracting"
-		if err := saveRestoreState(stateFile, state); err != nil {
+		if err := saveRestoreState(stateFile, r.key, state); err != nil {
 			fmt.Printf("Warning: Could not save restore state: %v\n", err)
 		}
 	}
@@ -1477,12 +1422,12 @@ func Restore(cfg Config, version string, restoreDir string) error {
 	// Phase 2: Extract files to final location
 	if state.Phase == "extracting" {
 		fmt.Println("Phase 2: Extracting files to final location...")
-		err = extractBackupFiles(&state, encryptionKey)
+		err = r.extractBackupFiles(&state, encryptionKey)
 		if err != nil {
-			return err
+			return fmt.Errorf("restore incomplete, could not extract all files: %w", err)
 		}
 		state.Phase = "completed"
-		if err := saveRestoreState(stateFile, state); err != nil {
+		if err := saveRestoreState(stateFile, r.key, state); err != nil {
 			fmt.Printf("Warning: Could not save restore state: %v\n", err)
 		}
 	}
@@ -1494,7 +1439,7 @@ func Restore(cfg Config, version string, restoreDir string) error {
 	
 	// Remove staging files (if they exist)
 	for _, hash := range state.CopiedFiles {
-		stageFilePath := state.StageDir + "\\" + hash
+		stageFilePath := filepath.Join(state.StageDir, hash)
 		if err := os.Remove(stageFilePath); err != nil {
 			// Only warn if file exists but can't be removed
 			if !os.IsNotExist(err) {
@@ -1524,159 +1469,138 @@ func Restore(cfg Config, version string, restoreDir string) error {
 	return nil
 }
 
-// copyBackupFiles copies backup files from backup directory to staging area
-func copyBackupFiles(state *RestoreState, versionFile string, encryptionKey []byte) error {
-	stateFile := state.RestoreDir + "\\restore_state.json"
-	// Read version file to get list of files
-	data, err := ioutil.ReadFile(versionFile)
-	if err != nil {
-		return fmt.Errorf("failed to read version file: %v", err)
-	}
+// copyBackupFiles copies backup files from backup directory to staging area.
+// Files that could not be copied are skipped and returned as BlobErrors.
+func (r *Repository) copyBackupFiles(state *RestoreState) error {
+	stateFile := filepath.Join(state.RestoreDir, restoreStateFileName)
+	var failed []error
 	
-	lines := strings.Split(string(data), "\r\n")
-	var currentFile string
-	var currentHash string
+	copied := map[string]bool{}
+	for _, hash := range state.CopiedFiles {
+		copied[hash] = true
+	}
 	
-	for _, line := range lines {
-		if strings.HasPrefix(line, "FILE:") {
-			currentFile = strings.TrimPrefix(line, "FILE:")
-		} else if strings.HasPrefix(line, "HASH:") {
-			currentHash = strings.TrimPrefix(line, "HASH:")
+	// Read version file to get list of files
+	_, err := r.readVersion(state.Version, func(e ManifestEntry) error {
+		for _, hash := range e.Blobs() {
+			// Check if already copied
+			if copied[hash] {
+				continue
+			}
 			
-			if currentFile != "" && currentHash != "" {
-				// Check if already copied
-				alreadyCopied := false
-				for _, copied := range state.CopiedFiles {
-					if copied == currentHash {
-						alreadyCopied = true
-						break
-					}
-				}
-				
-				if !alreadyCopied {
-					// Copy backup file to staging area
-					backupFilePath := state.BackupDir + "\\files\\" + currentHash[:2] + "\\" + currentHash
-					stageFilePath := state.StageDir + "\\" + currentHash
-					
-					fmt.Printf("Copying: %s\n", currentFile)
-					
-					// Simple file copy (backup files are already compressed/encrypted)
-					in, err := os.Open(backupFilePath)
-					if err != nil {
-						fmt.Printf("Warning: Could not open backup file %s: %v\n", backupFilePath, err)
-						continue
-					}
-					
-					out, err := os.Create(stageFilePath)
-					if err != nil {
-						in.Close()
-						fmt.Printf("Warning: Could not create stage file %s: %v\n", stageFilePath, err)
-						continue
-					}
-					
-					_, err = io.Copy(out, in)
-					in.Close()
-					out.Close()
-					
-					if err != nil {
-						fmt.Printf("Warning: Could not copy file %s: %v\n", currentFile, err)
-						continue
-					}
-					
-					state.CopiedFiles = append(state.CopiedFiles, currentHash)
-					
-					// Save state after each file for crash recovery
-					if err := saveRestoreState(stateFile, *state); err != nil {
-						fmt.Printf("Warning: Could not save restore state: %v\n", err)
-					}
-				}
-				
-				currentFile = ""
-				currentHash = ""
+			if err := r.copyBackupFile(state.StageDir, hash, e.Path); err != nil {
+				failed = append(failed, &BlobError{Hash: hash, Path: e.Path, Err: err})
+				continue
+			}
+			
+			copied[hash] = true
+			state.CopiedFiles = append(state.CopiedFiles, hash)
+			
+			// Save state after each file for crash recovery
+			if err := saveRestoreState(stateFile, r.key, *state); err != nil {
+				fmt.Printf("Warning: Could not save restore state: %v\n", err)
 			}
 		}
+		return nil
+	}, func(treeErr *BlobError) error {
+		fmt.Printf("Warning: Could not read folder %s: %v\n", treeErr.Path, treeErr.Err)
+		failed = append(failed, treeErr)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read version file: %w", err)
 	}
 	
-	return nil
+	return errors.Join(failed...)
 }
 
-// extractBackupFiles extracts files from staging area to final location
-func extractBackupFiles(state *RestoreState, encryptionKey []byte) error {
-	stateFile := state.RestoreDir + "\\restore_state.json"
-	// Read version file to get list of files and their original paths
-	versionFile := state.BackupDir + "\\version\\" + strconv.Itoa(state.Version)
-	data, err := ioutil.ReadFile(versionFile)
+// copyBackupFile copies one stored file to the staging area
+func (r *Repository) copyBackupFile(stageDir, hash, path string) error {
+	backupFilePath := r.blobFile(hash)
+	stageFilePath := filepath.Join(stageDir, hash)
+	
+	fmt.Printf("Copying: %s\n", path)
+	
+	// Simple file copy (backup files are already compressed/encrypted)
+	in, err := r.openBlob(hash)
 	if err != nil {
-		return fmt.Errorf("failed to read version file: %v", err)
+		fmt.Printf("Warning: Could not open backup file %s: %v\n", backupFilePath, err)
+		if os.IsNotExist(err) {
+			err = ErrBlobMissing
+		}
+		return err
 	}
+	defer in.Close()
 	
-	lines := strings.Split(string(data), "\r\n")
-	var currentFile string
-	var currentHash string
+	out, err := os.Create(stageFilePath)
+	if err != nil {
+		fmt.Printf("Warning: Could not create stage file %s: %v\n", stageFilePath, err)
+		return err
+	}
 	
-	for _, line := range lines {
-		if strings.HasPrefix(line, "FILE:") {
-			currentFile = strings.TrimPrefix(line, "FILE:")
-		} else if strings.HasPrefix(line, "HASH:") {
-			currentHash = strings.TrimPrefix(line, "HASH:")
-			
-			if currentFile != "" && currentHash != "" {
-				// Check if already extracted
-				alreadyExtracted := false
-				for _, extracted := range state.ExtractedFiles {
-					if extracted == currentFile {
-						alreadyExtracted = true
-						break
-					}
-				}
-				
-				if !alreadyExtracted {
-					// Extract file from staging area to restore directory
-					stageFilePath := state.StageDir + "\\" + currentHash
-					
-					// Calculate relative path from original file path
-					relativePath := filepath.Base(currentFile)
-					if strings.Contains(currentFile, "\\subdir\\") {
-						// Handle subdirectory structure
-						parts := strings.Split(currentFile, "\\")
-						if len(parts) >= 2 {
-							// Take last two parts for subdir/filename
-							relativePath = filepath.Join(parts[len(parts)-2], parts[len(parts)-1])
-						}
-					}
-					
-					// Create target path within restore directory
-					targetPath := filepath.Join(state.RestoreDir, relativePath)
-					
-					fmt.Printf("Extracting: %s -> %s\n", currentFile, targetPath)
-					
-					// Create directory structure if needed
-					dirPath := filepath.Dir(targetPath)
-					if err := os.MkdirAll(dirPath, 0755); err != nil {
-						fmt.Printf("Warning: Could not create directory %s: %v\n", dirPath, err)
-						continue
-					}
-					
-					// Extract and decrypt file
-					err := ExtractGZipAndDecrypt(stageFilePath, targetPath, encryptionKey)
-					if err != nil {
-						fmt.Printf("Warning: Could not extract file %s: %v\n", currentFile, err)
-						continue
-					}
-					
-					state.ExtractedFiles = append(state.ExtractedFiles, currentFile)
-					
-					// Save state after each file for crash recovery
-					if err := saveRestoreState(stateFile, *state); err != nil {
-						fmt.Printf("Warning: Could not save restore state: %v\n", err)
-					}
-				}
-				
-				currentFile = ""
-				currentHash = ""
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Printf("Warning: Could not copy file %s: %v\n", path, err)
+		return err
+	}
+	return nil
+}
+
+// extractBackupFiles extracts files from staging area to final location.
+// Files that could not be extracted are skipped and returned as BlobErrors.
+func (r *Repository) extractBackupFiles(state *RestoreState, encryptionKey []byte) error {
+	stateFile := filepath.Join(state.RestoreDir, restoreStateFileName)
+	var failed []error
+	
+	// Read version file to get list of files and their original paths
+	_, err := r.readVersion(state.Version, func(e ManifestEntry) error {
+		// Check if already extracted
+		for _, extracted := range state.ExtractedFiles {
+			if extracted == e.Path {
+				return nil
 			}
 		}
+		
+		// Calculate relative path from original file path
+		relativePath := restoreRelativePath(r.cfg.Include, e.Path)
+		
+		// Create target path within restore directory
+		targetPath := filepath.Join(state.RestoreDir, relativePath)
+		
+		fmt.Printf("Extracting: %s -> %s\n", e.Path, targetPath)
+		
+		// Create directory structure if needed
+		dirPath := filepath.Dir(targetPath)
+		if err := os.MkdirAll(dirPath, 0755); err != nil {
+			fmt.Printf("Warning: Could not create directory %s: %v\n", dirPath, err)
+			failed = append(failed, &BlobError{Hash: e.Hash, Path: e.Path, Err: err})
+			return nil
+		}
+		
+		// Extract and decrypt file from staging area to restore directory
+		if err := extractStagedFile(state.StageDir, e.Blobs(), targetPath, encryptionKey); err != nil {
+			fmt.Printf("Warning: Could not extract file %s: %v\n", e.Path, err)
+			failed = append(failed, &BlobError{Hash: e.Hash, Path: e.Path, Err: err})
+			return nil
+		}
+		
+		state.ExtractedFiles = append(state.ExtractedFiles, e.Path)
+		
+		// Save state after each file for crash recovery
+		if err := saveRestoreState(stateFile, r.key, *state); err != nil {
+			fmt.Printf("Warning: Could not save restore state: %v\n", err)
+		}
+		return nil
+	}, func(treeErr *BlobError) error {
+		failed = append(failed, treeErr)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read version file: %w", err)
 	}
 	
-	return nil
+	return errors.Join(failed...)
 }
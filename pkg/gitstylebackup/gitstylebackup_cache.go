@@ -0,0 +1,65 @@
+package gitstylebackup
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// changeCache holds the entries of the previous version so files whose
+// metadata did not change can reuse their hash instead of being read again
+type changeCache struct {
+	entries map[string]ManifestEntry
+}
+
+// loadChangeCache reads the entries of the previous version. It returns a nil
+// cache when every file has to be hashed again, together with the time of the
+// last full rehash to record in the new version.
+func (r *Repository) loadChangeCache(cfg Config, prevVersion string, now time.Time) (*changeCache, time.Time) {
+	if prevVersion == "" || cfg.FullRehash {
+		return nil, now
+	}
+
+	cache := &changeCache{entries: map[string]ManifestEntry{}}
+	header, err := r.readVersion(prevVersion, func(e ManifestEntry) error {
+		if !e.Changed {
+			cache.entries[e.Path] = e
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		fmt.Printf("Warning: Could not read version %s, hashing all files: %v\n", prevVersion, err)
+		return nil, now
+	}
+
+	if cfg.RehashDays > 0 && (header.FullHash.IsZero() ||
+		now.Sub(header.FullHash) >= time.Duration(cfg.RehashDays)*24*time.Hour) {
+		fmt.Println("Last full rehash is older than rehashDays, hashing all files")
+		return nil, now
+	}
+
+	return cache, header.FullHash
+}
+
+// lookup returns the previous entry of a file when its size, modification
+// time, inode and change time are all unchanged
+func (c *changeCache) lookup(path string, info os.FileInfo) (ManifestEntry, bool) {
+	if c == nil {
+		return ManifestEntry{}, false
+	}
+
+	e, ok := c.entries[path]
+	if !ok || e.Size != info.Size() || !e.ModTime.Equal(info.ModTime()) {
+		return ManifestEntry{}, false
+	}
+
+	// entries written without an identity only match on size and time
+	inode, ctime := fileIdentity(info)
+	if e.Inode != 0 && e.Inode != inode {
+		return ManifestEntry{}, false
+	}
+	if !e.ChangeTime.IsZero() && !e.ChangeTime.Equal(ctime) {
+		return ManifestEntry{}, false
+	}
+	return e, true
+}
@@ -0,0 +1,116 @@
+package gitstylebackup
+
+import (
+	"io"
+	"math/bits"
+)
+
+// gearTable holds the random values of the rolling gear hash. It is generated
+// from a fixed seed so chunk boundaries never change between releases, which
+// would stop new backups from sharing chunks with old ones.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	x := uint64(0x6a09e667f3bcc908)
+	for i := range table {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunker splits a stream into content defined chunks with FastCDC. A cut
+// point depends only on the bytes just before it, so inserting or removing
+// data in a large file only changes the chunks around the edit.
+type chunker struct {
+	r     io.Reader
+	buf   []byte
+	start int
+	end   int
+	eof   bool
+
+	min, avg, max int
+	maskS, maskL  uint64 // harder and easier cut masks before and after avg
+}
+
+// newChunker returns a chunker producing chunks of about avg bytes,
+// between avg/4 and avg*4
+func newChunker(r io.Reader, avg int) *chunker {
+	n := bits.Len(uint(avg)) - 1
+	return &chunker{
+		r:     r,
+		buf:   make([]byte, avg*8),
+		min:   avg / 4,
+		avg:   avg,
+		max:   avg * 4,
+		maskS: cutMask(n + 1),
+		maskL: cutMask(n - 1),
+	}
+}
+
+// cutMask returns a mask of n bits, the top bits of the gear hash depend on
+// the most bytes
+func cutMask(n int) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+// Next returns the next chunk, or io.EOF after the last one. The chunk is
+// only valid until the next call.
+func (c *chunker) Next() ([]byte, error) {
+	if c.end-c.start < c.max && !c.eof {
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+
+		n, err := io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// cut returns the length of the chunk at the start of data
+func (c *chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+	normal := c.avg
+	if normal > n {
+		normal = n
+	}
+
+	var h uint64
+	i := c.min
+	for ; i < normal; i++ {
+		h = (h << 1) + gearTable[data[i]]
+		if h&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = (h << 1) + gearTable[data[i]]
+		if h&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
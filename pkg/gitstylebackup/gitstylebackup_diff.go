@@ -0,0 +1,215 @@
+package gitstylebackup
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// VersionDiff lists the files whose content differs between two versions
+type VersionDiff struct {
+	From     string
+	To       string
+	Added    []string // files only in To
+	Removed  []string // files only in From
+	Modified []string // files in both with different content
+}
+
+// Diff compares two versions of a backup directory
+func Diff(cfg Config, from, to string) (VersionDiff, error) {
+	r, err := Open(cfg)
+	if err != nil {
+		return VersionDiff{}, err
+	}
+	return r.Diff(from, to)
+}
+
+// Diff compares two versions. Versions written with folder trees are compared
+// tree by tree, folders with the same tree in both are skipped without
+// reading them.
+func (r *Repository) Diff(from, to string) (VersionDiff, error) {
+	var d VersionDiff
+	var err error
+	if d.From, err = r.resolveVersion(from); err != nil {
+		return d, err
+	}
+	if d.To, err = r.resolveVersion(to); err != nil {
+		return d, err
+	}
+
+	fromHeader, err := r.versionHeader(d.From)
+	if err != nil {
+		return d, err
+	}
+	toHeader, err := r.versionHeader(d.To)
+	if err != nil {
+		return d, err
+	}
+
+	if fromHeader.Format >= 3 && toHeader.Format >= 3 {
+		err = r.diffRoots(&d, fromHeader.Roots, toHeader.Roots)
+	} else {
+		err = r.diffFiles(&d)
+	}
+	if err != nil {
+		return d, err
+	}
+
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Modified)
+	return d, nil
+}
+
+// versionHeader reads the header of a version file
+func (r *Repository) versionHeader(version string) (ManifestHeader, error) {
+	f, err := os.Open(r.versionFile(version))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ManifestHeader{}, fmt.Errorf("%w: version %s", ErrVersionNotFound, version)
+		}
+		return ManifestHeader{}, err
+	}
+	defer f.Close()
+
+	in, err := newSealedReader(f, r.key)
+	if err != nil {
+		return ManifestHeader{}, fmt.Errorf("error reading version file %s: %w", version, err)
+	}
+	mr, err := NewManifestReader(in)
+	if err != nil {
+		return ManifestHeader{}, fmt.Errorf("error reading version file %s: %w", version, err)
+	}
+	return mr.Header(), nil
+}
+
+// diffFiles compares two versions file by file, for versions written before
+// folder trees existed
+func (r *Repository) diffFiles(d *VersionDiff) error {
+	old := map[string]string{}
+	_, err := r.readVersion(d.From, func(e ManifestEntry) error {
+		old[e.Path] = e.Hash
+		return nil
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("error reading version file %s: %w", d.From, err)
+	}
+
+	_, err = r.readVersion(d.To, func(e ManifestEntry) error {
+		hash, ok := old[e.Path]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, e.Path)
+		case hash != e.Hash:
+			d.Modified = append(d.Modified, e.Path)
+		}
+		delete(old, e.Path)
+		return nil
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("error reading version file %s: %w", d.To, err)
+	}
+
+	for path := range old {
+		d.Removed = append(d.Removed, path)
+	}
+	return nil
+}
+
+// diffRoots compares the trees of the include paths of two versions
+func (r *Repository) diffRoots(d *VersionDiff, from, to []ManifestRoot) error {
+	oldRoots := map[string]string{}
+	for _, root := range from {
+		oldRoots[root.Path] = root.Tree
+	}
+
+	for _, root := range to {
+		oldTree, ok := oldRoots[root.Path]
+		delete(oldRoots, root.Path)
+		var err error
+		if ok {
+			err = r.diffTrees(d, root.Path, oldTree, root.Tree)
+		} else {
+			err = r.listTree(&d.Added, root.Path, root.Tree)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for path, tree := range oldRoots {
+		if err := r.listTree(&d.Removed, path, tree); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffTrees compares two trees of the folder dir
+func (r *Repository) diffTrees(d *VersionDiff, dir, oldHash, newHash string) error {
+	if oldHash == newHash {
+		return nil
+	}
+	oldEntries, err := r.readTree(oldHash)
+	if err != nil {
+		return &BlobError{Hash: oldHash, Path: dir, Err: err}
+	}
+	newEntries, err := r.readTree(newHash)
+	if err != nil {
+		return &BlobError{Hash: newHash, Path: dir, Err: err}
+	}
+
+	sep := recordedSeparator(dir)
+	old := map[string]treeEntry{}
+	for _, e := range oldEntries {
+		old[e.Name] = e
+	}
+
+	for _, e := range newEntries {
+		path := joinRecordedPath(dir, e.Name, sep)
+		prev, ok := old[e.Name]
+		delete(old, e.Name)
+
+		var err error
+		switch {
+		case !ok:
+			err = r.listEntry(&d.Added, path, e)
+		case prev.Type != e.Type:
+			if err = r.listEntry(&d.Removed, path, prev); err == nil {
+				err = r.listEntry(&d.Added, path, e)
+			}
+		case e.Type == treeEntryDir:
+			err = r.diffTrees(d, path, prev.Hash, e.Hash)
+		case prev.Hash != e.Hash:
+			d.Modified = append(d.Modified, path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for name, e := range old {
+		if err := r.listEntry(&d.Removed, joinRecordedPath(dir, name, sep), e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listEntry adds a file, or every file below a folder, to list
+func (r *Repository) listEntry(list *[]string, path string, e treeEntry) error {
+	if e.Type == treeEntryDir {
+		return r.listTree(list, path, e.Hash)
+	}
+	*list = append(*list, path)
+	return nil
+}
+
+// listTree adds every file below a tree to list
+func (r *Repository) listTree(list *[]string, dir, hash string) error {
+	w := &treeWalker{r: r, fn: func(e ManifestEntry) error {
+		*list = append(*list, e.Path)
+		return nil
+	}}
+	return w.walk(dir, hash, recordedSeparator(dir))
+}
@@ -0,0 +1,39 @@
+package gitstylebackup
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by repository operations. Test for them with errors.Is,
+// they are usually wrapped with details about the version or file involved.
+var (
+	ErrNotRepository   = errors.New("not a backup directory")
+	ErrRepositoryInUse = errors.New("backup directory is in use")
+	ErrVersionNotFound = errors.New("backup version not found")
+	ErrBlobMissing     = errors.New("backup file missing")
+	ErrBlobCorrupt     = errors.New("backup file corrupt")
+	ErrWrongKey        = errors.New("wrong encryption key")
+	ErrCorruptManifest = errors.New("corrupt version file")
+
+	ErrNeedsMigration        = errors.New("backup directory needs migration")
+	ErrUnsupportedRepository = errors.New("unsupported backup directory")
+)
+
+// BlobError reports a problem with a single stored file
+type BlobError struct {
+	Hash string // hash of the stored file
+	Path string // original path of the file, empty when unknown
+	Err  error
+}
+
+func (e *BlobError) Error() string {
+	if e.Path != "" {
+		return fmt.Sprintf("%s (%s): %v", e.Path, e.Hash, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Hash, e.Err)
+}
+
+func (e *BlobError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,18 @@
+//go:build darwin || freebsd || netbsd
+
+package gitstylebackup
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// fileIdentity returns the inode number and status change time of a file
+func fileIdentity(info os.FileInfo) (uint64, time.Time) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, time.Time{}
+	}
+	return uint64(st.Ino), time.Unix(int64(st.Ctimespec.Sec), int64(st.Ctimespec.Nsec))
+}
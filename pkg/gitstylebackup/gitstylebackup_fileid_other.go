@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !netbsd
+
+package gitstylebackup
+
+import (
+	"os"
+	"time"
+)
+
+// fileIdentity returns no identity on systems without inode numbers in
+// their file info, files are then compared on size and time only
+func fileIdentity(info os.FileInfo) (uint64, time.Time) {
+	return 0, time.Time{}
+}
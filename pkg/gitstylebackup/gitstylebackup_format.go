@@ -0,0 +1,509 @@
+package gitstylebackup
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RepositoryFormat is the newest backup directory format this package writes.
+// Format 1 directories were written before Repository.json existed and have
+// to be migrated before they can be used. Format 3 stores versions as folder
+// trees, which older programs cannot read. Format 4 encrypts stored files as
+// streams of segments. Format 5 encrypts new repositories with a master key
+// kept in Keys.json. Format 6 records a check of the key of encrypted
+// repositories, so a wrong key is refused before anything is written. Format
+// 7 encrypts the version files and pack indexes of encrypted repositories.
+// Format 8 names the stored files of new encrypted repositories with an HMAC
+// keyed by the master key.
+const RepositoryFormat = 8
+
+const repositoryConfigFileName = "Repository.json"
+
+// Values of the RepositoryConfig fields understood by this package
+const (
+	hashSHA1            = "sha1"
+	hashSHA256          = "sha256"
+	hashHMACSHA256      = "hmac-sha256" // sha256 keyed by the repository key, for encrypted repositories
+	compressGzip        = "gzip"
+	encryptAESGCM       = "aes-256-gcm"        // whole files sealed at once, before format 4
+	encryptAESGCMStream = "aes-256-gcm-stream" // files sealed in segments
+	keyFromSHA256       = "sha256-password"    // before format 5
+	keyFromKeyFile      = "keyfile"            // before format 5
+	keyFromKeysFile     = "scrypt-keys"        // master key in Keys.json
+)
+
+// RepositoryConfig describes the layout of a backup directory. It is written
+// by Init and checked by every operation before it touches any data.
+type RepositoryConfig struct {
+	Format        int       `json:"format"`
+	ID            string    `json:"id"`
+	Created       time.Time `json:"created"`
+	HashAlgorithm string    `json:"hashAlgorithm"`
+	ShardDepth    int       `json:"shardDepth,omitempty"` // folder levels of two hex characters for sha256 names
+	Compression   string    `json:"compression"`
+	ChunkSizeKB   int       `json:"chunkSizeKB,omitempty"` // average chunk size, 0 when chunking is off
+	Encryption    string    `json:"encryption,omitempty"`  // empty when the repository is not encrypted
+	KeyDerivation string    `json:"keyDerivation,omitempty"`
+	KeyCheck      string    `json:"keyCheck,omitempty"` // HMAC of the repository id with the key, see keyCheck
+}
+
+// maxShardDepth limits the folder levels blobs are spread over
+const maxShardDepth = 3
+
+// newRepositoryConfig returns the config for a new repository created from cfg
+func newRepositoryConfig(cfg Config) (RepositoryConfig, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return RepositoryConfig{}, err
+	}
+
+	rc := RepositoryConfig{
+		Format:        RepositoryFormat,
+		ID:            hex.EncodeToString(id),
+		Created:       time.Now().UTC(),
+		HashAlgorithm: hashSHA256,
+		ShardDepth:    cfg.ShardDepth,
+		Compression:   compressGzip,
+		ChunkSizeKB:   cfg.ChunkSizeKB,
+	}
+	if rc.ShardDepth == 0 {
+		rc.ShardDepth = 1
+	}
+	if rc.ShardDepth < 1 || rc.ShardDepth > maxShardDepth {
+		return RepositoryConfig{}, fmt.Errorf("shard depth %d is not between 1 and %d", rc.ShardDepth, maxShardDepth)
+	}
+	if cfg.EncryptKeyFile != "" || cfg.EncryptPassword != "" {
+		rc.Encryption, rc.KeyDerivation = encryptAESGCMStream, keyFromKeysFile
+		rc.HashAlgorithm = hashHMACSHA256
+	}
+	return rc, nil
+}
+
+// readRepositoryConfig reads the repository config of a backup directory
+func readRepositoryConfig(path string) (RepositoryConfig, error) {
+	var rc RepositoryConfig
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return rc, err
+	}
+	if err := json.Unmarshal(data, &rc); err != nil {
+		return rc, fmt.Errorf("%w: %s: %v", ErrUnsupportedRepository, repositoryConfigFileName, err)
+	}
+	return rc, nil
+}
+
+// writeRepositoryConfig writes the repository config of a backup directory
+func writeRepositoryConfig(path string, rc RepositoryConfig) error {
+	data, err := json.MarshalIndent(rc, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, func(out io.Writer) error {
+		_, err := out.Write(data)
+		return err
+	})
+}
+
+// validate checks that this program can use a repository with the given key
+func (rc RepositoryConfig) validate(key []byte) error {
+	if rc.Format > RepositoryFormat {
+		return fmt.Errorf("%w: format %d was written by a newer version of this program", ErrUnsupportedRepository, rc.Format)
+	}
+	if rc.Format < RepositoryFormat {
+		return fmt.Errorf("%w: format %d, run --migrate", ErrNeedsMigration, rc.Format)
+	}
+	switch rc.HashAlgorithm {
+	case hashSHA1:
+	case hashSHA256, hashHMACSHA256:
+		if rc.ShardDepth < 1 || rc.ShardDepth > maxShardDepth {
+			return fmt.Errorf("%w: shard depth %d is not between 1 and %d", ErrUnsupportedRepository, rc.ShardDepth, maxShardDepth)
+		}
+	default:
+		return fmt.Errorf("%w: unknown hash algorithm %q", ErrUnsupportedRepository, rc.HashAlgorithm)
+	}
+	if rc.Compression != compressGzip {
+		return fmt.Errorf("%w: unknown compression %q", ErrUnsupportedRepository, rc.Compression)
+	}
+
+	switch rc.Encryption {
+	case "":
+		if key != nil {
+			return fmt.Errorf("%w: the backup directory is not encrypted but an encryption key was given", ErrWrongKey)
+		}
+	case encryptAESGCMStream:
+		if key == nil {
+			return fmt.Errorf("%w: the backup directory is encrypted but no encryption key was given", ErrWrongKey)
+		}
+		switch rc.KeyDerivation {
+		case keyFromSHA256, keyFromKeyFile, keyFromKeysFile:
+		default:
+			return fmt.Errorf("%w: unknown key derivation %q", ErrUnsupportedRepository, rc.KeyDerivation)
+		}
+	default:
+		return fmt.Errorf("%w: unknown encryption %q", ErrUnsupportedRepository, rc.Encryption)
+	}
+	if rc.HashAlgorithm == hashHMACSHA256 && rc.Encryption == "" {
+		return fmt.Errorf("%w: stored files are named with a key but the backup directory is not encrypted", ErrUnsupportedRepository)
+	}
+	return nil
+}
+
+// checkKey checks the key of an encrypted repository against its key check
+func (rc RepositoryConfig) checkKey(key []byte) error {
+	if rc.Encryption == "" {
+		return nil
+	}
+	if rc.KeyCheck == "" {
+		return fmt.Errorf("%w: the backup directory has no key check", ErrUnsupportedRepository)
+	}
+	if !hmac.Equal([]byte(rc.KeyCheck), []byte(keyCheck(key, rc.ID))) {
+		return fmt.Errorf("%w: the key does not match the key of the backup directory", ErrWrongKey)
+	}
+	return nil
+}
+
+// migrations upgrade a repository from the format at their index to the next one
+var migrations = map[int]func(r *Repository) error{
+	1: migrateFormat1,
+	2: migrateFormat2,
+	3: migrateFormat3,
+	4: migrateFormat4,
+	5: migrateFormat5,
+	6: migrateFormat6,
+	7: migrateFormat7,
+}
+
+// migrateFormat1 adds the repository config and pack folder to a backup
+// directory written before either existed. Version files of format 1 stay
+// readable and need no changes.
+func migrateFormat1(r *Repository) error {
+	if err := os.MkdirAll(r.packDir, 0755); err != nil {
+		return fmt.Errorf("failed to create pack directory: %v", err)
+	}
+
+	rc, err := newRepositoryConfig(r.cfg)
+	if err != nil {
+		return err
+	}
+	rc.Format = 2
+	rc.HashAlgorithm = hashSHA1 // stored files keep their names
+	rc.ShardDepth = 0
+
+	// the key given, or none, must open the files already stored
+	if err := r.checkStoredKey(); err != nil {
+		return err
+	}
+	if rc.Encryption != "" {
+		// format 1 directories only knew a password hashed with sha256 or a key file
+		rc.KeyDerivation = keyFromSHA256
+		if r.cfg.EncryptKeyFile != "" {
+			rc.KeyDerivation = keyFromKeyFile
+		}
+		fmt.Println("Marking backup directory encrypted, the given key is used for all files")
+	}
+	return writeRepositoryConfig(r.configFile, rc)
+}
+
+// migrateFormat2 marks a backup directory as holding folder trees. Versions
+// written before list their files themselves and stay readable as they are.
+func migrateFormat2(r *Repository) error {
+	rc, err := readRepositoryConfig(r.configFile)
+	if err != nil {
+		return err
+	}
+	rc.Format = 3
+	return writeRepositoryConfig(r.configFile, rc)
+}
+
+// migrateFormat3 switches an encrypted backup directory to encrypting new
+// files as streams. Files encrypted at once before stay readable as they are.
+func migrateFormat3(r *Repository) error {
+	rc, err := readRepositoryConfig(r.configFile)
+	if err != nil {
+		return err
+	}
+	rc.Format = 4
+	if rc.Encryption == encryptAESGCM {
+		rc.Encryption = encryptAESGCMStream
+	}
+	return writeRepositoryConfig(r.configFile, rc)
+}
+
+// migrateFormat4 only marks the format. Encrypted backup directories keep
+// the key they were created with, their files stay encrypted with it and
+// cannot move to a master key without being written again.
+func migrateFormat4(r *Repository) error {
+	rc, err := readRepositoryConfig(r.configFile)
+	if err != nil {
+		return err
+	}
+	rc.Format = 5
+	if rc.Encryption != "" && rc.KeyDerivation != keyFromKeysFile {
+		fmt.Println("Warning: the backup directory keeps its unsalted key, back up to a new backup directory to use a key file")
+	}
+	return writeRepositoryConfig(r.configFile, rc)
+}
+
+// migrateFormat5 records the key check of an encrypted backup directory. The
+// key given is only recorded once it opens a stored file, so a mistyped
+// password cannot become the key of the backup directory.
+func migrateFormat5(r *Repository) error {
+	rc, err := readRepositoryConfig(r.configFile)
+	if err != nil {
+		return err
+	}
+	rc.Format = 6
+
+	if rc.Encryption != "" && rc.KeyCheck == "" {
+		r.repoCfg = rc
+		if err := r.unlock(); err != nil {
+			return err
+		}
+		if err := r.checkStoredKey(); err != nil {
+			return err
+		}
+		rc.KeyCheck = keyCheck(r.key, rc.ID)
+	}
+	return writeRepositoryConfig(r.configFile, rc)
+}
+
+// migrateFormat6 encrypts the version files and pack indexes of an encrypted
+// backup directory, they list every path, size and date in plain text.
+// Files encrypted already by an interrupted migration are left as they are.
+func migrateFormat6(r *Repository) error {
+	rc, err := readRepositoryConfig(r.configFile)
+	if err != nil {
+		return err
+	}
+	rc.Format = 7
+
+	if rc.Encryption != "" {
+		r.repoCfg = rc
+		if err := r.unlock(); err != nil {
+			return err
+		}
+		if err := rc.checkKey(r.key); err != nil {
+			return err
+		}
+		for _, dir := range []string{r.versionDir, r.packDir} {
+			if err := sealFolder(dir, r.key); err != nil {
+				return err
+			}
+		}
+	}
+	return writeRepositoryConfig(r.configFile, rc)
+}
+
+// migrateFormat7 only marks the format. The stored files of an encrypted
+// backup directory keep their names, renaming them would mean rewriting
+// every version, and the names still reveal which known files are stored.
+func migrateFormat7(r *Repository) error {
+	rc, err := readRepositoryConfig(r.configFile)
+	if err != nil {
+		return err
+	}
+	rc.Format = 8
+	if rc.Encryption != "" && rc.HashAlgorithm != hashHMACSHA256 {
+		fmt.Println("Warning: stored files keep names made from their content, back up to a new backup directory to name them with the key")
+	}
+	return writeRepositoryConfig(r.configFile, rc)
+}
+
+// sealFolder encrypts the files in dir that are not encrypted yet
+func sealFolder(dir string, key []byte) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasSuffix(name, tempFileSuffix) || strings.HasSuffix(name, packSuffix) {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if isStream(data) {
+			continue
+		}
+		fmt.Println("Encrypting " + path)
+		if err := writeSealedFile(path, key, data); err != nil {
+			return fmt.Errorf("error encrypting %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// Migrate upgrades a backup directory to the current format. With copyTo set
+// the backup directory is first copied there and only the copy is upgraded.
+func Migrate(cfg Config, copyTo string) error {
+	if copyTo != "" {
+		if err := copyRepository(cfg.BackupDir, copyTo); err != nil {
+			return fmt.Errorf("error copying backup directory: %v", err)
+		}
+		cfg.BackupDir = copyTo
+	}
+
+	r, err := newRepository(cfg)
+	if err != nil {
+		return err
+	}
+
+	format, err := r.detectFormat()
+	if err != nil {
+		return err
+	}
+	if format == RepositoryFormat {
+		fmt.Println("Backup directory is already at format", format)
+		return nil
+	}
+	if format > RepositoryFormat {
+		return fmt.Errorf("%w: format %d was written by a newer version of this program", ErrUnsupportedRepository, format)
+	}
+
+	if err := r.Lock(); err != nil {
+		return err
+	}
+	defer r.Unlock()
+
+	for ; format < RepositoryFormat; format++ {
+		fmt.Printf("Migrating backup directory from format %d to %d\n", format, format+1)
+		if err := migrations[format](r); err != nil {
+			return fmt.Errorf("error migrating from format %d: %w", format, err)
+		}
+	}
+
+	r.repoCfg, err = readRepositoryConfig(r.configFile)
+	if err != nil {
+		return err
+	}
+	return r.checkConfig()
+}
+
+// detectFormat returns the format of a backup directory, 1 for directories
+// without a repository config
+func (r *Repository) detectFormat() (int, error) {
+	rc, err := readRepositoryConfig(r.configFile)
+	if err == nil {
+		return rc.Format, nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	exists, err := FolderExists(r.versionDir)
+	if err != nil || !exists {
+		return 0, fmt.Errorf("%w: no version folder found in %s", ErrNotRepository, r.root)
+	}
+	return 1, nil
+}
+
+// copyRepository copies a backup directory to an empty or missing folder
+func copyRepository(src, dst string) error {
+	if entries, err := ioutil.ReadDir(dst); err == nil && len(entries) > 0 {
+		return fmt.Errorf("%s is not empty", dst)
+	}
+	src = filepath.Clean(src)
+
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if rel == "InUse.txt" {
+			return nil
+		}
+
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		return writeFileAtomic(target, func(out io.Writer) error {
+			_, err := io.Copy(out, in)
+			return err
+		})
+	})
+}
+
+// newHash returns the hash naming the stored files of the repository. The
+// stored files of encrypted repositories are named with a MAC keyed by the
+// repository key, so their names do not tell which content they hold.
+func (r *Repository) newHash() hash.Hash {
+	switch r.repoCfg.HashAlgorithm {
+	case hashSHA1:
+		return sha1.New()
+	case hashHMACSHA256:
+		return hmac.New(sha256.New, r.idKey)
+	}
+	return sha256.New()
+}
+
+// hashName renders a hash as the name of a stored file. Format 1 repositories
+// used SHA-1 written as 3 digit decimals, newer ones use hex.
+func (r *Repository) hashName(sum []byte) string {
+	if r.repoCfg.HashAlgorithm == hashSHA1 {
+		return HashToString(sum)
+	}
+	return hex.EncodeToString(sum)
+}
+
+// hashData returns the name of the stored file holding data
+func (r *Repository) hashData(data []byte) string {
+	h := r.newHash()
+	h.Write(data)
+	return r.hashName(h.Sum(nil))
+}
+
+// hashFile returns the name of the stored file holding the content of path
+func (r *Repository) hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := r.newHash()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return r.hashName(h.Sum(nil)), nil
+}
+
+// shardDirs returns the folders below Files holding a stored file
+func (r *Repository) shardDirs(hash string) []string {
+	if r.repoCfg.HashAlgorithm == hashSHA1 {
+		return []string{hash[:2]}
+	}
+	var dirs []string
+	for i := 0; i < r.repoCfg.ShardDepth && len(hash) >= 2*(i+1); i++ {
+		dirs = append(dirs, hash[2*i:2*i+2])
+	}
+	return dirs
+}
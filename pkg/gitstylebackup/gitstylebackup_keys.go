@@ -0,0 +1,554 @@
+package gitstylebackup
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The files of an encrypted backup directory are encrypted with a random
+// master key. Keys.json holds the master key sealed with a key derived by
+// scrypt from the password, or from the whole content of the key file, with
+// the salt and parameters used. Every password guess costs a scrypt run, and
+// the password only unlocks the master key, it never encrypts files itself.
+//
+// Like LUKS, Keys.json has slots, each sealing the same master key with
+// another password, so passwords can be added, changed and removed without
+// touching any stored file.
+//
+// Backup directories encrypted before Keys.json existed keep using the
+// password hashed with sha256, or the key file, as their key.
+const keysFileName = "Keys.json"
+
+const (
+	kdfScrypt     = "scrypt"
+	masterKeySize = 32
+
+	// costs of new keys, log2 of scrypt's n. n = 2^15 with r = 8 uses 32 MiB.
+	defaultKeyCost = 15
+	minKeyCost     = 10
+	maxKeyCost     = 24
+	scryptR        = 8
+	scryptP        = 1
+
+	// limits what a damaged Keys.json can make a reader compute
+	maxScryptR = 32
+	maxScryptP = 16
+)
+
+// keysFile is the content of Keys.json
+type keysFile struct {
+	Keys []wrappedKey `json:"keys"`
+}
+
+// wrappedKey is the master key sealed with a key derived from a password
+type wrappedKey struct {
+	Name    string    `json:"name,omitempty"`
+	Created time.Time `json:"created"`
+	KDF     string    `json:"kdf"`
+	N       int       `json:"n"`
+	R       int       `json:"r"`
+	P       int       `json:"p"`
+	Salt    []byte    `json:"salt"`
+	Sealed  []byte    `json:"sealed"` // nonce and master key sealed with AES-GCM
+}
+
+// keySecret returns what unlocks the master key of cfg, nil without encryption
+func keySecret(cfg Config) ([]byte, error) {
+	if cfg.EncryptPassword != "" {
+		return []byte(cfg.EncryptPassword), nil
+	}
+
+	if cfg.EncryptKeyFile != "" {
+		secret, err := ioutil.ReadFile(cfg.EncryptKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %v", err)
+		}
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("key file %s is empty", cfg.EncryptKeyFile)
+		}
+		return secret, nil
+	}
+
+	return nil, nil
+}
+
+// keyCost returns the scrypt cost of new keys of cfg
+func keyCost(cfg Config) (int, error) {
+	if cfg.KeyCost == 0 {
+		return defaultKeyCost, nil
+	}
+	if cfg.KeyCost < minKeyCost || cfg.KeyCost > maxKeyCost {
+		return 0, fmt.Errorf("key cost %d is not between %d and %d", cfg.KeyCost, minKeyCost, maxKeyCost)
+	}
+	return cfg.KeyCost, nil
+}
+
+// wrapKey seals master with a key derived from secret at the given cost
+func wrapKey(master, secret []byte, cost int) (wrappedKey, error) {
+	w := wrappedKey{
+		Created: time.Now().UTC(),
+		KDF:     kdfScrypt,
+		N:       1 << uint(cost),
+		R:       scryptR,
+		P:       scryptP,
+		Salt:    make([]byte, 32),
+	}
+	if _, err := io.ReadFull(rand.Reader, w.Salt); err != nil {
+		return w, err
+	}
+
+	kek, err := w.derive(secret)
+	if err != nil {
+		return w, err
+	}
+	w.Sealed, err = encryptData(master, kek)
+	return w, err
+}
+
+// id names a slot by the start of its salt, which is random and never changes
+func (w wrappedKey) id() string {
+	if len(w.Salt) < 4 {
+		return ""
+	}
+	return hex.EncodeToString(w.Salt[:4])
+}
+
+// derive returns the key sealing the master key for secret
+func (w wrappedKey) derive(secret []byte) ([]byte, error) {
+	if w.KDF != kdfScrypt {
+		return nil, fmt.Errorf("%w: unknown key derivation %q in %s", ErrUnsupportedRepository, w.KDF, keysFileName)
+	}
+	if w.N > 1<<maxKeyCost || w.R < 1 || w.R > maxScryptR || w.P < 1 || w.P > maxScryptP {
+		return nil, fmt.Errorf("%w: scrypt parameters n=%d r=%d p=%d in %s", ErrUnsupportedRepository, w.N, w.R, w.P, keysFileName)
+	}
+	key, err := scrypt(secret, w.Salt, w.N, w.R, w.P, masterKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrUnsupportedRepository, keysFileName, err)
+	}
+	return key, nil
+}
+
+// unwrap returns the master key, ErrWrongKey when secret does not open it
+func (w wrappedKey) unwrap(secret []byte) ([]byte, error) {
+	kek, err := w.derive(secret)
+	if err != nil {
+		return nil, err
+	}
+	master, err := decryptData(w.Sealed, kek)
+	if errors.Is(err, errNotAuthentic) {
+		return nil, fmt.Errorf("%w: key slot %s", ErrWrongKey, w.id())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: key slot %s: %v", ErrUnsupportedRepository, w.id(), err)
+	}
+	if len(master) != masterKeySize {
+		return nil, fmt.Errorf("%w: master key of %d bytes in %s", ErrUnsupportedRepository, len(master), keysFileName)
+	}
+	return master, nil
+}
+
+// readKeysFile reads Keys.json
+func readKeysFile(path string) (keysFile, error) {
+	var kf keysFile
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return kf, err
+	}
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return kf, fmt.Errorf("%w: %s: %v", ErrUnsupportedRepository, keysFileName, err)
+	}
+	return kf, nil
+}
+
+// writeKeysFile writes Keys.json
+func writeKeysFile(path string, kf keysFile) error {
+	data, err := json.MarshalIndent(kf, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, func(out io.Writer) error {
+		_, err := out.Write(data)
+		return err
+	})
+}
+
+// createKeysFile writes a new Keys.json with a random master key unlocked
+// by the secret of cfg and returns the master key
+func createKeysFile(path string, cfg Config) ([]byte, error) {
+	secret, err := keySecret(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, errors.New("no password or key file given")
+	}
+	cost, err := keyCost(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	master := make([]byte, masterKeySize)
+	if _, err := io.ReadFull(rand.Reader, master); err != nil {
+		return nil, err
+	}
+	w, err := wrapKey(master, secret, cost)
+	if err != nil {
+		return nil, err
+	}
+	return master, writeKeysFile(path, keysFile{Keys: []wrappedKey{w}})
+}
+
+// keyCheck returns what Repository.json records to recognize the key of a
+// repository. It is a MAC of the repository id, it reveals nothing about
+// the key and ties Keys.json to the repository it was made for.
+func keyCheck(key []byte, id string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("gitstylebackup key check " + id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// blobIDKey returns the key naming the stored files of a repository. It is
+// derived from the repository key so names and content are keyed apart.
+func blobIDKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("gitstylebackup blob id"))
+	return mac.Sum(nil)
+}
+
+// checkStoredKey opens a stored file with the key of the repository, nil
+// when no file is stored yet. It is used before a key is recorded, a key
+// that does not open the stored files, or one given for unencrypted files,
+// is refused with ErrWrongKey or ErrBlobCorrupt.
+func (r *Repository) checkStoredKey() error {
+	raw, name, err := r.anyStoredFile()
+	if err != nil || raw == nil {
+		return err
+	}
+
+	in, err := newStoredFileReader(raw, r.key)
+	if err == nil {
+		defer in.Close()
+		_, err = io.CopyN(ioutil.Discard, in, 1)
+	}
+	switch {
+	case err == nil || err == io.EOF:
+		return nil
+	case errors.Is(err, errNotAuthentic):
+		// no key was checked yet, so a file failing authentication means a wrong key
+		return fmt.Errorf("%w: the key does not open stored file %s", ErrWrongKey, name)
+	}
+	return fmt.Errorf("stored file %s: %w", name, err)
+}
+
+// anyStoredFile opens a loose or packed stored file, nil when there is none
+func (r *Repository) anyStoredFile() (io.ReadCloser, string, error) {
+	errFound := errors.New("found")
+	found := ""
+	err := filepath.Walk(r.filesDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && !strings.HasSuffix(path, tempFileSuffix) {
+			found = path
+			return errFound
+		}
+		return nil
+	})
+	if err != nil && err != errFound && !os.IsNotExist(err) {
+		return nil, "", err
+	}
+	if found != "" {
+		f, err := os.Open(found)
+		return f, filepath.Base(found), err
+	}
+
+	hash, ok, err := r.packs.anyBlob()
+	if err != nil || !ok {
+		return nil, "", err
+	}
+	raw, err := r.openBlob(hash)
+	return raw, hash, err
+}
+
+// unlockMasterKey returns the master key stored in Keys.json at path and
+// the id of the slot secret unlocked it with
+func unlockMasterKey(path string, secret []byte) ([]byte, string, error) {
+	kf, err := readKeysFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	master, slot, err := kf.unlock(secret)
+	if err != nil {
+		return nil, "", err
+	}
+	return master, kf.Keys[slot].id(), nil
+}
+
+// unlock returns the master key and the slot secret unlocks it with
+func (kf keysFile) unlock(secret []byte) ([]byte, int, error) {
+	if len(kf.Keys) == 0 {
+		return nil, 0, fmt.Errorf("%w: %s holds no keys", ErrUnsupportedRepository, keysFileName)
+	}
+
+	for i, w := range kf.Keys {
+		master, err := w.unwrap(secret)
+		if err == nil {
+			return master, i, nil
+		}
+		if !errors.Is(err, ErrWrongKey) {
+			return nil, 0, err
+		}
+	}
+	return nil, 0, fmt.Errorf("%w: the password or key file does not unlock %s", ErrWrongKey, keysFileName)
+}
+
+// find returns the index of the slot with the given id or name, -1 if none
+func (kf keysFile) find(slot string) int {
+	for i, w := range kf.Keys {
+		if w.id() == slot {
+			return i
+		}
+	}
+	for i, w := range kf.Keys {
+		if w.Name != "" && w.Name == slot {
+			return i
+		}
+	}
+	return -1
+}
+
+// KeySlot describes one password or key file unlocking an encrypted backup
+// directory
+type KeySlot struct {
+	ID      string
+	Name    string
+	Created time.Time
+	KDF     string
+	N, R, P int
+	Current bool // unlocked by the config the repository was opened with
+}
+
+// Keys lists the key slots of an encrypted backup directory
+func Keys(cfg Config) ([]KeySlot, error) {
+	r, err := Open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return r.Keys()
+}
+
+// AddKey adds a key slot unlocked by the password or key file of newKey
+func AddKey(cfg Config, name string, newKey Config) (KeySlot, error) {
+	r, err := Open(cfg)
+	if err != nil {
+		return KeySlot{}, err
+	}
+	return r.AddKey(name, newKey)
+}
+
+// RemoveKey removes a key slot by id or name
+func RemoveKey(cfg Config, slot string) error {
+	r, err := Open(cfg)
+	if err != nil {
+		return err
+	}
+	return r.RemoveKey(slot)
+}
+
+// ChangeKey changes the password or key file of the slot unlocked by cfg to
+// the one of newKey
+func ChangeKey(cfg Config, newKey Config) error {
+	r, err := Open(cfg)
+	if err != nil {
+		return err
+	}
+	return r.ChangeKey(newKey)
+}
+
+// checkKeySlots returns an error for repositories without Keys.json
+func (r *Repository) checkKeySlots() error {
+	if r.repoCfg.Encryption == "" {
+		return errors.New("the backup directory is not encrypted")
+	}
+	if r.repoCfg.KeyDerivation != keyFromKeysFile {
+		return fmt.Errorf("%w: the backup directory was encrypted before key slots existed, back up to a new backup directory to use them", ErrUnsupportedRepository)
+	}
+	return nil
+}
+
+// Keys lists the key slots of the repository
+func (r *Repository) Keys() ([]KeySlot, error) {
+	if err := r.checkKeySlots(); err != nil {
+		return nil, err
+	}
+	kf, err := readKeysFile(r.keysFile)
+	if err != nil {
+		return nil, err
+	}
+
+	slots := make([]KeySlot, 0, len(kf.Keys))
+	for _, w := range kf.Keys {
+		slots = append(slots, KeySlot{
+			ID:      w.id(),
+			Name:    w.Name,
+			Created: w.Created,
+			KDF:     w.KDF,
+			N:       w.N,
+			R:       w.R,
+			P:       w.P,
+			Current: w.id() == r.keyID,
+		})
+	}
+	return slots, nil
+}
+
+// AddKey adds a key slot sealing the master key with the password or key
+// file of newKey, at the key cost of newKey
+func (r *Repository) AddKey(name string, newKey Config) (KeySlot, error) {
+	if err := r.checkKeySlots(); err != nil {
+		return KeySlot{}, err
+	}
+	secret, cost, err := newKeySecret(newKey)
+	if err != nil {
+		return KeySlot{}, err
+	}
+
+	if err := r.Lock(); err != nil {
+		return KeySlot{}, err
+	}
+	defer r.Unlock()
+
+	kf, err := readKeysFile(r.keysFile)
+	if err != nil {
+		return KeySlot{}, err
+	}
+	if name != "" && kf.find(name) >= 0 {
+		return KeySlot{}, fmt.Errorf("a key slot named %s already exists", name)
+	}
+	if err := kf.checkUnused(secret); err != nil {
+		return KeySlot{}, err
+	}
+
+	w, err := wrapKey(r.key, secret, cost)
+	if err != nil {
+		return KeySlot{}, err
+	}
+	w.Name = name
+	kf.Keys = append(kf.Keys, w)
+	if err := writeKeysFile(r.keysFile, kf); err != nil {
+		return KeySlot{}, fmt.Errorf("failed to write %s: %v", keysFileName, err)
+	}
+	return KeySlot{ID: w.id(), Name: w.Name, Created: w.Created, KDF: w.KDF, N: w.N, R: w.R, P: w.P}, nil
+}
+
+// RemoveKey removes a key slot by id or name. The last slot cannot be
+// removed, nothing could unlock the backup directory without it.
+func (r *Repository) RemoveKey(slot string) error {
+	if err := r.checkKeySlots(); err != nil {
+		return err
+	}
+
+	if err := r.Lock(); err != nil {
+		return err
+	}
+	defer r.Unlock()
+
+	kf, err := readKeysFile(r.keysFile)
+	if err != nil {
+		return err
+	}
+	i := kf.find(slot)
+	if i < 0 {
+		return fmt.Errorf("no key slot %s", slot)
+	}
+	if len(kf.Keys) == 1 {
+		return fmt.Errorf("key slot %s is the last one, add another key first", slot)
+	}
+
+	kf.Keys = append(kf.Keys[:i], kf.Keys[i+1:]...)
+	if err := writeKeysFile(r.keysFile, kf); err != nil {
+		return fmt.Errorf("failed to write %s: %v", keysFileName, err)
+	}
+	return nil
+}
+
+// ChangeKey seals the master key in the slot unlocked by the repository's
+// config with the password or key file of newKey instead
+func (r *Repository) ChangeKey(newKey Config) error {
+	if err := r.checkKeySlots(); err != nil {
+		return err
+	}
+	secret, cost, err := newKeySecret(newKey)
+	if err != nil {
+		return err
+	}
+
+	if err := r.Lock(); err != nil {
+		return err
+	}
+	defer r.Unlock()
+
+	kf, err := readKeysFile(r.keysFile)
+	if err != nil {
+		return err
+	}
+	i := kf.find(r.keyID)
+	if i < 0 {
+		return fmt.Errorf("key slot %s was removed", r.keyID)
+	}
+	if err := kf.checkUnused(secret); err != nil {
+		return err
+	}
+
+	w, err := wrapKey(r.key, secret, cost)
+	if err != nil {
+		return err
+	}
+	w.Name = kf.Keys[i].Name
+	kf.Keys[i] = w
+	if err := writeKeysFile(r.keysFile, kf); err != nil {
+		return fmt.Errorf("failed to write %s: %v", keysFileName, err)
+	}
+	r.keyID = w.id()
+	return nil
+}
+
+// newKeySecret returns the secret and key cost of a new key slot
+func newKeySecret(newKey Config) ([]byte, int, error) {
+	secret, err := keySecret(newKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	if secret == nil {
+		return nil, 0, errors.New("no password or key file given for the new key")
+	}
+	cost, err := keyCost(newKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	return secret, cost, nil
+}
+
+// checkUnused returns an error when secret already unlocks a slot, a
+// password in two slots would keep working after removing one of them
+func (kf keysFile) checkUnused(secret []byte) error {
+	_, slot, err := kf.unlock(secret)
+	if err == nil {
+		return fmt.Errorf("the new password or key file already unlocks key slot %s", kf.Keys[slot].id())
+	}
+	if errors.Is(err, ErrWrongKey) {
+		return nil
+	}
+	return err
+}
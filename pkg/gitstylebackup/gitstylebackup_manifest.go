@@ -0,0 +1,724 @@
+package gitstylebackup
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ManifestFormat is the version file format written by this package.
+// Format 1 files, written before the format header existed, can still be read.
+// Format 3 added the folder trees of the include paths, a version written
+// with trees has no entries of its own. Format 4 added who made the version,
+// why, and what it stored. Format 5 names versions instead of numbering them.
+const ManifestFormat = 5
+
+// manifestMagic starts the first line of every version file since format 2
+const manifestMagic = "GITSTYLEBACKUP MANIFEST "
+
+// ManifestHeader holds the version information at the top of a version file
+type ManifestHeader struct {
+	Format   int       // format of the file, 1 for files without a format header
+	Version  string    // version name, a number for versions written before format 5
+	Date     time.Time // when the backup was started
+	FullHash time.Time // when every file was last hashed, zero when unknown
+
+	// Since format 4, all empty when unknown
+	Parent     string   // version the backup compared against, empty for the first one
+	Host       string   // computer the backup ran on
+	Source     string   // version stream of the backup, empty when written before sources existed
+	User       string   // user that ran the backup
+	Program    string   // version of the program that wrote it
+	ConfigHash string   // hash of the config the backup used
+	Includes   []string // include paths of that config
+	Message    string   // message given to the backup
+	Tags       []string // names of the version, each names a single version
+	Pinned     bool     // trim keeps the version
+	Totals     VersionTotals
+
+	Roots []ManifestRoot
+}
+
+// ManifestRoot points to the folder tree stored for one include path
+type ManifestRoot struct {
+	Path string // folder the tree describes
+	Tree string // hash of the stored tree
+}
+
+// ManifestEntry is the version file entry of one backed up file
+type ManifestEntry struct {
+	Path    string    // full path of the original file
+	ModTime time.Time // modification time of the original file
+	Size    int64     // size in bytes, format 1 files only recorded it in whole bytes of a megabyte
+	Hash    string    // hash of the original content, naming the stored file unless it is chunked
+	Chunks  []string  // hashes of the stored chunks in order, empty when stored as one file
+	Changed bool      // the file changed while it was backed up, the stored content may be inconsistent
+
+	// Inode and ChangeTime identify the file on systems that have them,
+	// so later backups can tell an unchanged file without reading it
+	Inode      uint64
+	ChangeTime time.Time
+}
+
+// Blobs returns the hashes of the stored files holding the content of the entry
+func (e ManifestEntry) Blobs() []string {
+	if len(e.Chunks) > 0 {
+		return e.Chunks
+	}
+	return []string{e.Hash}
+}
+
+// ManifestWriter writes a version file in the current format. Entries are
+// written in the order given, paths are escaped so any file name is safe, and
+// Close adds the entry count and a checksum so truncated files are detected.
+type ManifestWriter struct {
+	w     *bufio.Writer
+	sum   hash.Hash
+	count int
+	err   error
+}
+
+// NewManifestWriter writes the header of a version file to w. The header is
+// checked first, nothing is written for an invalid one.
+func NewManifestWriter(w io.Writer, header ManifestHeader) (*ManifestWriter, error) {
+	if !validVersionID(header.Version) {
+		return nil, fmt.Errorf("invalid version %q", header.Version)
+	}
+	for _, root := range header.Roots {
+		if root.Path == "" || root.Tree == "" {
+			return nil, fmt.Errorf("manifest root needs a path and a tree: %+v", root)
+		}
+	}
+
+	mw := &ManifestWriter{
+		w:   bufio.NewWriter(w),
+		sum: sha256.New(),
+	}
+
+	mw.writeLine(manifestMagic + strconv.Itoa(ManifestFormat))
+	mw.writeLine("VERSION:" + header.Version)
+	mw.writeLine("DATE:" + header.Date.Format(time.RFC3339Nano))
+	if !header.FullHash.IsZero() {
+		mw.writeLine("REHASHED:" + header.FullHash.Format(time.RFC3339Nano))
+	}
+	mw.writeMetadata(header)
+	for _, root := range header.Roots {
+		mw.writeLine("ROOT:" + escapeManifestValue(root.Path))
+		mw.writeLine("TREE:" + root.Tree)
+	}
+	return mw, mw.err
+}
+
+// writeMetadata writes the header fields describing how the version was made
+func (mw *ManifestWriter) writeMetadata(header ManifestHeader) {
+	if header.Parent != "" {
+		mw.writeLine("PARENT:" + header.Parent)
+	}
+	optional := []struct{ key, value string }{
+		{"HOST", header.Host},
+		{"SOURCE", header.Source},
+		{"USER", header.User},
+		{"PROGRAM", header.Program},
+		{"CONFIG", header.ConfigHash},
+	}
+	for _, o := range optional {
+		if o.value != "" {
+			mw.writeLine(o.key + ":" + escapeManifestValue(o.value))
+		}
+	}
+	for _, include := range header.Includes {
+		mw.writeLine("INCLUDE:" + escapeManifestValue(include))
+	}
+	if header.Message != "" {
+		mw.writeLine("MESSAGE:" + escapeManifestValue(header.Message))
+	}
+	for _, tag := range header.Tags {
+		mw.writeLine("TAG:" + escapeManifestValue(tag))
+	}
+	if header.Pinned {
+		mw.writeLine("PINNED:1")
+	}
+	mw.writeLine("FILES:" + strconv.Itoa(header.Totals.Files))
+	mw.writeLine("BYTES:" + strconv.FormatInt(header.Totals.Bytes, 10))
+	mw.writeLine("NEWBLOBS:" + strconv.Itoa(header.Totals.NewBlobs))
+	mw.writeLine("ERRORS:" + strconv.Itoa(header.Totals.Errors))
+}
+
+// writeLine writes one line and adds it to the checksum
+func (mw *ManifestWriter) writeLine(line string) {
+	if mw.err != nil {
+		return
+	}
+	line += fileNewLine
+	if _, err := mw.w.WriteString(line); err != nil {
+		mw.err = err
+		return
+	}
+	mw.sum.Write([]byte(line))
+}
+
+// Write adds an entry to the version file
+func (mw *ManifestWriter) Write(e ManifestEntry) error {
+	if e.Path == "" || e.Hash == "" {
+		return fmt.Errorf("manifest entry needs a path and a hash: %+v", e)
+	}
+
+	mw.writeLine("FILE:" + escapeManifestValue(e.Path))
+	mw.writeLine("MTIME:" + e.ModTime.Format(time.RFC3339Nano))
+	mw.writeLine("SIZE:" + strconv.FormatInt(e.Size, 10))
+	mw.writeLine("HASH:" + e.Hash)
+	for _, chunk := range e.Chunks {
+		mw.writeLine("CHUNK:" + chunk)
+	}
+	if e.Inode != 0 {
+		mw.writeLine("INODE:" + strconv.FormatUint(e.Inode, 10))
+	}
+	if !e.ChangeTime.IsZero() {
+		mw.writeLine("CTIME:" + e.ChangeTime.Format(time.RFC3339Nano))
+	}
+	if e.Changed {
+		mw.writeLine("CHANGED:1")
+	}
+	mw.count++
+	return mw.err
+}
+
+// Close writes the entry count and checksum and flushes the file.
+// It does not close the underlying writer.
+func (mw *ManifestWriter) Close() error {
+	mw.writeLine("COUNT:" + strconv.Itoa(mw.count))
+	if mw.err != nil {
+		return mw.err
+	}
+
+	checksum := hex.EncodeToString(mw.sum.Sum(nil))
+	if _, err := mw.w.WriteString("CHECKSUM:" + checksum + fileNewLine); err != nil {
+		return err
+	}
+	return mw.w.Flush()
+}
+
+// ManifestReader reads version files of any supported format
+type ManifestReader struct {
+	r       *bufio.Reader
+	sum     hash.Hash
+	header  ManifestHeader
+	pending string // line read ahead while looking for the end of an entry
+	hasLine bool
+	count   int
+	done    bool
+}
+
+// NewManifestReader reads the header of a version file from r
+func NewManifestReader(r io.Reader) (*ManifestReader, error) {
+	mr := &ManifestReader{
+		r:   bufio.NewReader(r),
+		sum: sha256.New(),
+	}
+
+	line, err := mr.readLine()
+	if err != nil {
+		return nil, corruptManifest("missing header: %v", err)
+	}
+
+	if strings.HasPrefix(line, manifestMagic) {
+		format, err := strconv.Atoi(line[len(manifestMagic):])
+		if err != nil {
+			return nil, corruptManifest("invalid format line %q", line)
+		}
+		if format < 2 || format > ManifestFormat {
+			return nil, fmt.Errorf("version file format %d is not supported by this program", format)
+		}
+		mr.header.Format = format
+	} else {
+		// format 1 files start directly with the version line
+		mr.header.Format = 1
+		mr.unreadLine(line)
+	}
+
+	for {
+		line, err := mr.readLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		key, value := splitManifestLine(line)
+		switch key {
+		case "VERSION":
+			mr.header.Version = value
+			if !validVersionID(value) {
+				return nil, corruptManifest("invalid version line %q", line)
+			}
+		case "DATE":
+			mr.header.Date, err = mr.parseTime(value)
+			if err != nil {
+				return nil, corruptManifest("invalid date line %q", line)
+			}
+		case "REHASHED":
+			mr.header.FullHash, err = mr.parseTime(value)
+			if err != nil || mr.header.Format == 1 {
+				return nil, corruptManifest("invalid rehash line %q", line)
+			}
+		case "PARENT", "HOST", "SOURCE", "USER", "PROGRAM", "CONFIG", "INCLUDE", "MESSAGE", "TAG", "PINNED",
+			"FILES", "BYTES", "NEWBLOBS", "ERRORS":
+			if mr.header.Format < 4 || len(mr.header.Roots) > 0 {
+				return nil, corruptManifest("unexpected line %q", line)
+			}
+			if err := mr.readMetadata(key, value); err != nil {
+				return nil, corruptManifest("invalid line %q: %v", line, err)
+			}
+		case "ROOT":
+			if mr.header.Format < 3 || !mr.rootsComplete() {
+				return nil, corruptManifest("unexpected root line %q", line)
+			}
+			path, err := unescapeManifestValue(value, mr.header.Format)
+			if err != nil {
+				return nil, err
+			}
+			mr.header.Roots = append(mr.header.Roots, ManifestRoot{Path: path})
+		case "TREE":
+			last := len(mr.header.Roots) - 1
+			if last < 0 || mr.header.Roots[last].Tree != "" || len(value) < 2 {
+				return nil, corruptManifest("unexpected tree line %q", line)
+			}
+			mr.header.Roots[last].Tree = value
+		default:
+			if !mr.rootsComplete() {
+				return nil, corruptManifest("root has no tree")
+			}
+			mr.unreadLine(line)
+			return mr, nil
+		}
+	}
+
+	if mr.header.Format >= 2 {
+		return nil, corruptManifest("file ends before its checksum")
+	}
+	return mr, nil
+}
+
+// readMetadata reads one of the header lines written by writeMetadata
+func (mr *ManifestReader) readMetadata(key, value string) error {
+	h := &mr.header
+	var err error
+	switch key {
+	case "PARENT":
+		h.Parent = value
+		if !validVersionID(value) {
+			err = fmt.Errorf("invalid version %q", value)
+		}
+	case "PINNED":
+		h.Pinned = value == "1"
+	case "FILES":
+		h.Totals.Files, err = strconv.Atoi(value)
+	case "BYTES":
+		h.Totals.Bytes, err = strconv.ParseInt(value, 10, 64)
+	case "NEWBLOBS":
+		h.Totals.NewBlobs, err = strconv.Atoi(value)
+	case "ERRORS":
+		h.Totals.Errors, err = strconv.Atoi(value)
+	default:
+		if value, err = unescapeManifestValue(value, mr.header.Format); err != nil {
+			return err
+		}
+		switch key {
+		case "HOST":
+			h.Host = value
+		case "SOURCE":
+			h.Source = value
+		case "USER":
+			h.User = value
+		case "PROGRAM":
+			h.Program = value
+		case "CONFIG":
+			h.ConfigHash = value
+		case "INCLUDE":
+			h.Includes = append(h.Includes, value)
+		case "MESSAGE":
+			h.Message = value
+		case "TAG":
+			h.Tags = append(h.Tags, value)
+		}
+	}
+	return err
+}
+
+// rootsComplete reports whether every root read so far has its tree
+func (mr *ManifestReader) rootsComplete() bool {
+	roots := mr.header.Roots
+	return len(roots) == 0 || roots[len(roots)-1].Tree != ""
+}
+
+// Header returns the header read by NewManifestReader
+func (mr *ManifestReader) Header() ManifestHeader {
+	return mr.header
+}
+
+// Next returns the next entry. It returns io.EOF after the last entry once
+// the count and checksum of the file have been checked.
+func (mr *ManifestReader) Next() (ManifestEntry, error) {
+	if mr.done {
+		return ManifestEntry{}, io.EOF
+	}
+
+	line, err := mr.readLine()
+	if err == io.EOF && mr.header.Format == 1 {
+		mr.done = true
+		return ManifestEntry{}, io.EOF
+	}
+	if err == io.EOF {
+		return ManifestEntry{}, corruptManifest("file ends before its checksum")
+	}
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+
+	key, value := splitManifestLine(line)
+	if key == "COUNT" && mr.header.Format >= 2 {
+		return ManifestEntry{}, mr.readTrailer(value)
+	}
+	if key != "FILE" {
+		return ManifestEntry{}, corruptManifest("expected a FILE line, got %q", line)
+	}
+
+	var e ManifestEntry
+	e.Path, err = unescapeManifestValue(value, mr.header.Format)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+
+	var haveTime, haveSize bool
+	for {
+		line, err := mr.readLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ManifestEntry{}, err
+		}
+
+		key, value := splitManifestLine(line)
+		switch {
+		case key == "MTIME" && mr.header.Format >= 2, key == "MODDATE" && mr.header.Format == 1:
+			e.ModTime, err = mr.parseTime(value)
+			if err != nil {
+				return ManifestEntry{}, corruptManifest("invalid time line %q", line)
+			}
+			haveTime = true
+		case key == "SIZE":
+			if mr.header.Format == 1 {
+				// format 1 recorded megabytes with 6 decimals
+				var mb float64
+				mb, err = strconv.ParseFloat(value, 64)
+				e.Size = int64(math.Round(mb * 1024 * 1024))
+			} else {
+				e.Size, err = strconv.ParseInt(value, 10, 64)
+			}
+			if err != nil {
+				return ManifestEntry{}, corruptManifest("invalid size line %q", line)
+			}
+			haveSize = true
+		case key == "HASH":
+			if len(value) < 2 {
+				return ManifestEntry{}, corruptManifest("invalid hash line %q", line)
+			}
+			e.Hash = value
+		case key == "CHUNK" && mr.header.Format >= 2:
+			if len(value) < 2 {
+				return ManifestEntry{}, corruptManifest("invalid chunk line %q", line)
+			}
+			e.Chunks = append(e.Chunks, value)
+		case key == "INODE" && mr.header.Format >= 2:
+			e.Inode, err = strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return ManifestEntry{}, corruptManifest("invalid inode line %q", line)
+			}
+		case key == "CTIME" && mr.header.Format >= 2:
+			e.ChangeTime, err = mr.parseTime(value)
+			if err != nil {
+				return ManifestEntry{}, corruptManifest("invalid change time line %q", line)
+			}
+		case key == "CHANGED" && mr.header.Format >= 2:
+			e.Changed = value == "1"
+		case key == "FILE" || key == "COUNT":
+			mr.unreadLine(line)
+			return mr.finishEntry(e, haveTime, haveSize)
+		case mr.header.Format == 1 && !haveTime && !haveSize && e.Hash == "":
+			// format 1 wrote paths unescaped, a line ending in a file name
+			// splits its FILE line
+			e.Path += "\n" + line
+		default:
+			return ManifestEntry{}, corruptManifest("unexpected line %q", line)
+		}
+
+		// format 1 entries end with their hash line
+		if mr.header.Format == 1 && e.Hash != "" {
+			break
+		}
+	}
+
+	return mr.finishEntry(e, haveTime, haveSize)
+}
+
+// finishEntry checks that an entry has all the fields its format requires
+func (mr *ManifestReader) finishEntry(e ManifestEntry, haveTime, haveSize bool) (ManifestEntry, error) {
+	if e.Hash == "" {
+		return ManifestEntry{}, corruptManifest("entry %q has no hash", e.Path)
+	}
+	if mr.header.Format >= 2 && (!haveTime || !haveSize) {
+		return ManifestEntry{}, corruptManifest("entry %q is incomplete", e.Path)
+	}
+	mr.count++
+	return e, nil
+}
+
+// readTrailer checks the entry count and checksum at the end of the file
+func (mr *ManifestReader) readTrailer(countValue string) error {
+	count, err := strconv.Atoi(countValue)
+	if err != nil || count != mr.count {
+		return corruptManifest("file lists %d entries but records %q", mr.count, countValue)
+	}
+
+	expected := hex.EncodeToString(mr.sum.Sum(nil))
+	line, err := mr.readRawLine()
+	if err != nil {
+		return corruptManifest("file ends before its checksum")
+	}
+	key, value := splitManifestLine(line)
+	if key != "CHECKSUM" || value != expected {
+		return corruptManifest("checksum does not match")
+	}
+
+	if _, err := mr.readRawLine(); err != io.EOF {
+		return corruptManifest("unexpected data after checksum")
+	}
+
+	mr.done = true
+	return io.EOF
+}
+
+// readLine returns the next line without its line ending and adds it to the checksum
+func (mr *ManifestReader) readLine() (string, error) {
+	if mr.hasLine {
+		mr.hasLine = false
+		return mr.pending, nil
+	}
+
+	line, err := mr.r.ReadString('\n')
+	if err == io.EOF && line != "" && mr.header.Format == 1 {
+		// format 1 files may miss the final line ending
+		err = nil
+	} else if err == io.EOF && line != "" {
+		return "", corruptManifest("file ends in the middle of a line")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	mr.sum.Write([]byte(line))
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readRawLine returns the next line without adding it to the checksum
+func (mr *ManifestReader) readRawLine() (string, error) {
+	line, err := mr.r.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return "", io.EOF
+	}
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// unreadLine puts a line back so the next readLine returns it again
+func (mr *ManifestReader) unreadLine(line string) {
+	mr.pending = line
+	mr.hasLine = true
+}
+
+// parseTime parses a time in the format of the file
+func (mr *ManifestReader) parseTime(value string) (time.Time, error) {
+	if mr.header.Format == 1 {
+		return time.Parse(timeFormat, value)
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// splitManifestLine splits a line into its key and value
+func splitManifestLine(line string) (string, string) {
+	i := strings.Index(line, ":")
+	if i < 0 {
+		return line, ""
+	}
+	return line[:i], line[i+1:]
+}
+
+// corruptManifest returns an error wrapping ErrCorruptManifest
+func corruptManifest(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrCorruptManifest, fmt.Sprintf(format, a...))
+}
+
+// escapeManifestValue escapes the characters that would break a version file line
+func escapeManifestValue(value string) string {
+	if !strings.ContainsAny(value, "%\r\n") {
+		return value
+	}
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '%', '\r', '\n':
+			fmt.Fprintf(&sb, "%%%02X", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// unescapeManifestValue reverses escapeManifestValue, format 1 files were not escaped
+func unescapeManifestValue(value string, format int) (string, error) {
+	if format == 1 || !strings.Contains(value, "%") {
+		return value, nil
+	}
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '%' {
+			sb.WriteByte(value[i])
+			continue
+		}
+		if i+2 >= len(value) {
+			return "", corruptManifest("invalid escape in %q", value)
+		}
+		c, err := strconv.ParseUint(value[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", corruptManifest("invalid escape in %q", value)
+		}
+		sb.WriteByte(byte(c))
+		i += 2
+	}
+	return sb.String(), nil
+}
+
+// readManifestFile reads a version file, encrypted with key when given, and
+// calls fn for every entry
+func readManifestFile(path string, key []byte, fn func(ManifestEntry) error) (ManifestHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return ManifestHeader{}, err
+	}
+	defer f.Close()
+
+	in, err := newSealedReader(f, key)
+	if err != nil {
+		return ManifestHeader{}, fmt.Errorf("%s: %w", path, err)
+	}
+	mr, err := NewManifestReader(in)
+	if err != nil {
+		return ManifestHeader{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for {
+		e, err := mr.Next()
+		if err == io.EOF {
+			return mr.Header(), nil
+		}
+		if err != nil {
+			return mr.Header(), fmt.Errorf("%s: %w", path, err)
+		}
+		if err := fn(e); err != nil {
+			return mr.Header(), err
+		}
+	}
+}
+
+// manifestCollector gathers the entries of a new version. Backup workers
+// send their entries to it over a channel so entries can never interleave,
+// and it sorts them by path so the trees built from them are deterministic.
+type manifestCollector struct {
+	entries chan ManifestEntry
+	done    chan struct{}
+	sorted  []ManifestEntry
+}
+
+// newManifestCollector starts collecting the entries of a new version
+func newManifestCollector() *manifestCollector {
+	m := &manifestCollector{
+		entries: make(chan ManifestEntry, 64),
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		for e := range m.entries {
+			m.sorted = append(m.sorted, e)
+		}
+		sort.Slice(m.sorted, func(i, j int) bool { return m.sorted[i].Path < m.sorted[j].Path })
+		close(m.done)
+	}()
+
+	return m
+}
+
+// Add queues an entry, it is safe to call from several goroutines
+func (m *manifestCollector) Add(e ManifestEntry) {
+	m.entries <- e
+}
+
+// Close stops collecting entries and waits until they are sorted.
+// Add must not be called after Close.
+func (m *manifestCollector) Close() {
+	close(m.entries)
+	<-m.done
+}
+
+// Entries returns the entries sorted by path, only valid after Close
+func (m *manifestCollector) Entries() []ManifestEntry {
+	return m.sorted
+}
+
+// writeVersionFile writes a version file to path, encrypted with key when
+// given, and syncs it to disk
+func writeVersionFile(path string, key []byte, header ManifestHeader, entries []ManifestEntry) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening version file: %v", err)
+	}
+	defer f.Close()
+
+	out, err := newSealedWriter(f, key)
+	if err != nil {
+		return fmt.Errorf("error writing version file: %v", err)
+	}
+	mw, err := NewManifestWriter(out, header)
+	if err != nil {
+		return fmt.Errorf("error writing version file: %v", err)
+	}
+	for _, e := range entries {
+		if err := mw.Write(e); err != nil {
+			return fmt.Errorf("error writing version file: %v", err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return fmt.Errorf("error writing version file: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("error writing version file: %v", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("error syncing version file: %v", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,130 @@
+package gitstylebackup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"unicode"
+)
+
+// ProgramVersion is recorded in every version written, the command line
+// program sets it to its own version
+var ProgramVersion = "dev"
+
+// VersionTotals summarizes what a backup stored
+type VersionTotals struct {
+	Files    int   // files in the version
+	Bytes    int64 // original size of those files
+	NewBlobs int   // stored files and trees the backup had to write
+	Errors   int   // files and folders that could not be backed up
+}
+
+// configHash identifies the config a version was made with, without
+// revealing the encryption password
+func configHash(cfg Config) string {
+	cfg.EncryptPassword = ""
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hostName returns the name of this computer, empty when unknown
+func hostName() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// userName returns the name of the user running the backup, empty when unknown
+func userName() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return os.Getenv("USERNAME")
+}
+
+// checkTagName rejects tag names that are empty, could be mistaken for a
+// version number, name or selector, or would not fit on one line of a version file
+func checkTagName(name string) error {
+	if name == "" {
+		return fmt.Errorf("invalid tag %q: tag names must not be empty", name)
+	}
+	if strings.IndexFunc(name, func(c rune) bool { return c < '0' || c > '9' }) < 0 {
+		return fmt.Errorf("invalid tag %q: tag names must not be a number", name)
+	}
+	if _, isDate := parseDateSelector(name); isDate || validVersionID(name) || strings.HasPrefix(name, latestVersionName) {
+		return fmt.Errorf("invalid tag %q: tag names must not look like a version", name)
+	}
+	if strings.IndexFunc(name, func(c rune) bool { return unicode.IsSpace(c) || unicode.IsControl(c) || c == ',' }) >= 0 {
+		return fmt.Errorf("invalid tag %q: tag names must not contain spaces or commas", name)
+	}
+	return nil
+}
+
+// ListVersions returns the headers of the versions of the config's source
+// in a backup directory
+func ListVersions(cfg Config) ([]ManifestHeader, error) {
+	r, err := Open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return r.ListVersions()
+}
+
+// ListAllVersions returns the headers of the versions of every source in a
+// backup directory
+func ListAllVersions(cfg Config) ([]ManifestHeader, error) {
+	r, err := Open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return r.ListAllVersions()
+}
+
+// ListVersions returns the headers of the versions of this repository's
+// source from oldest to newest
+func (r *Repository) ListVersions() ([]ManifestHeader, error) {
+	all, err := r.ListAllVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	source := r.source()
+	var headers []ManifestHeader
+	for _, h := range all {
+		if h.inSource(source) {
+			headers = append(headers, h)
+		}
+	}
+	return headers, nil
+}
+
+// ListAllVersions returns the headers of all versions from oldest to newest
+func (r *Repository) ListAllVersions() ([]ManifestHeader, error) {
+	versions, err := r.Versions()
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make([]ManifestHeader, 0, len(versions))
+	for _, ver := range versions {
+		header, err := r.versionHeader(ver)
+		if err != nil {
+			return headers, err
+		}
+		headers = append(headers, header)
+	}
+	return headers, nil
+}
@@ -0,0 +1,489 @@
+package gitstylebackup
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Stored files up to packBlobLimit bytes are appended to pack files instead
+// of being stored loose, a pack is closed once it reaches packTargetSize.
+const (
+	packBlobLimit  = 256 * 1024
+	packTargetSize = 32 * 1024 * 1024
+)
+
+const (
+	packSuffix  = ".pack"
+	indexSuffix = ".idx"
+)
+
+// packIndexEntry locates a stored file inside a pack
+type packIndexEntry struct {
+	Hash   string `json:"hash"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// packIndex is the index file written next to every complete pack.
+// A pack without an index was interrupted and is removed by Fix.
+type packIndex struct {
+	Blobs []packIndexEntry `json:"blobs"`
+}
+
+// packLocation is where a packed file is found
+type packLocation struct {
+	pack string
+	packIndexEntry
+}
+
+// packStore keeps the index of all packs in a repository and the pack
+// currently being written by a backup
+type packStore struct {
+	dir string
+	key []byte // encrypts the pack indexes, nil when not encrypted
+
+	mu     sync.Mutex
+	loaded bool
+	held   bool // the repository lock is held, no one else changes the packs
+	blobs  map[string]packLocation
+	packs  map[string][]packIndexEntry
+	dups   bool // some file is held by more than one pack
+	cur    *packWriter
+}
+
+// packWriter appends stored files to a new pack
+type packWriter struct {
+	id      string
+	file    *os.File
+	size    int64
+	entries []packIndexEntry
+}
+
+// load reads the indexes of all complete packs, the caller must hold mu
+func (p *packStore) load() error {
+	if p.loaded {
+		return nil
+	}
+
+	p.blobs = map[string]packLocation{}
+	p.packs = map[string][]packIndexEntry{}
+	p.dups = false
+	if err := p.refresh(); err != nil {
+		return err
+	}
+	p.loaded = true
+	return nil
+}
+
+// refresh reads the indexes of packs written since they were read and drops
+// packs removed since, by another Repository or process. The caller must
+// hold mu.
+func (p *packStore) refresh() error {
+	dirFiles, err := ioutil.ReadDir(p.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("error reading pack folder: %v", err)
+	}
+
+	found := map[string]bool{}
+	for _, df := range dirFiles {
+		if df.IsDir() || !strings.HasSuffix(df.Name(), indexSuffix) {
+			continue
+		}
+		id := strings.TrimSuffix(df.Name(), indexSuffix)
+		found[id] = true
+		if _, known := p.packs[id]; known {
+			continue
+		}
+
+		data, err := readSealedFile(filepath.Join(p.dir, df.Name()), p.key)
+		if err != nil {
+			return fmt.Errorf("error reading pack index %s: %w", id, err)
+		}
+		var index packIndex
+		if err := json.Unmarshal(data, &index); err != nil {
+			return fmt.Errorf("%w: pack index %s: %v", ErrCorruptManifest, id, err)
+		}
+
+		p.addPack(id, index.Blobs)
+	}
+
+	for id := range p.packs {
+		if !found[id] && (p.cur == nil || id != p.cur.id) {
+			p.removePack(id)
+		}
+	}
+	return nil
+}
+
+// hold records whether the repository lock is held. Taking it makes the
+// indexes be read again, others may have written or repacked packs while
+// it was free.
+func (p *packStore) hold(held bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if held && p.cur == nil {
+		p.loaded = false
+	}
+	p.held = held
+}
+
+// addPack adds the entries of a pack to the index, the caller must hold mu
+func (p *packStore) addPack(id string, entries []packIndexEntry) {
+	p.packs[id] = entries
+	for _, e := range entries {
+		// a repack interrupted before removing the old pack leaves a blob in two packs
+		if _, exists := p.blobs[e.Hash]; exists {
+			p.dups = true
+			continue
+		}
+		p.blobs[e.Hash] = packLocation{pack: id, packIndexEntry: e}
+	}
+}
+
+// removePack removes a pack from the index, the caller must hold mu
+func (p *packStore) removePack(id string) {
+	for _, e := range p.packs[id] {
+		if loc, ok := p.blobs[e.Hash]; ok && loc.pack == id {
+			delete(p.blobs, e.Hash)
+		}
+	}
+	delete(p.packs, id)
+
+	// blobs also held by another pack stay available from there
+	if !p.dups {
+		return
+	}
+	for other, entries := range p.packs {
+		for _, e := range entries {
+			if _, ok := p.blobs[e.Hash]; !ok {
+				p.blobs[e.Hash] = packLocation{pack: other, packIndexEntry: e}
+			}
+		}
+	}
+}
+
+// lookup returns where a packed file is stored. Without the repository
+// lock a file not found may be in a pack written since the indexes were
+// read, they are read again then.
+func (p *packStore) lookup(hash string) (packLocation, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.load(); err != nil {
+		return packLocation{}, false, err
+	}
+	loc, ok := p.blobs[hash]
+	if !ok && !p.held {
+		if err := p.refresh(); err != nil {
+			return packLocation{}, false, err
+		}
+		loc, ok = p.blobs[hash]
+	}
+	return loc, ok, nil
+}
+
+// relookup reads the indexes again and returns where a packed file is
+// stored now, for a pack removed by a repack since they were read
+func (p *packStore) relookup(hash string) (packLocation, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.load(); err != nil {
+		return packLocation{}, false, err
+	}
+	if err := p.refresh(); err != nil {
+		return packLocation{}, false, err
+	}
+	loc, ok := p.blobs[hash]
+	return loc, ok, nil
+}
+
+// anyBlob returns the hash of some packed file, ok is false without packs
+func (p *packStore) anyBlob() (string, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.load(); err != nil {
+		return "", false, err
+	}
+	for hash := range p.blobs {
+		return hash, true, nil
+	}
+	return "", false, nil
+}
+
+// packPath returns the path of a pack file
+func (p *packStore) packPath(id string) string {
+	return filepath.Join(p.dir, id+packSuffix)
+}
+
+// indexPath returns the path of a pack index file
+func (p *packStore) indexPath(id string) string {
+	return filepath.Join(p.dir, id+indexSuffix)
+}
+
+// newPackWriter starts a new pack with a random name
+func (p *packStore) newPackWriter() (*packWriter, error) {
+	if err := os.MkdirAll(p.dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create pack directory: %v", err)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	w := &packWriter{id: hex.EncodeToString(id)}
+
+	var err error
+	w.file, err = os.OpenFile(p.packPath(w.id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// add appends a stored file to the pack
+func (w *packWriter) add(hash string, src io.Reader) error {
+	n, err := io.Copy(w.file, src)
+	if err != nil {
+		return err
+	}
+	w.entries = append(w.entries, packIndexEntry{Hash: hash, Offset: w.size, Length: n})
+	w.size += n
+	return nil
+}
+
+// finish syncs the pack and writes its index, which makes the pack part of the repository
+func (p *packStore) finish(w *packWriter) error {
+	err := w.file.Sync()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing pack %s: %v", w.id, err)
+	}
+
+	data, err := json.Marshal(packIndex{Blobs: w.entries})
+	if err != nil {
+		return err
+	}
+	if err := writeSealedFile(p.indexPath(w.id), p.key, data); err != nil {
+		return fmt.Errorf("error writing pack index %s: %v", w.id, err)
+	}
+	return nil
+}
+
+// put appends a complete stored file from tmpName to the current pack unless
+// the file is already packed. The temp file is left for the caller to remove.
+func (p *packStore) put(hash, tmpName string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.load(); err != nil {
+		return false, err
+	}
+	if _, ok := p.blobs[hash]; ok {
+		return false, nil
+	}
+
+	if p.cur == nil {
+		w, err := p.newPackWriter()
+		if err != nil {
+			return false, err
+		}
+		p.cur = w
+		p.packs[w.id] = nil
+	}
+
+	in, err := os.Open(tmpName)
+	if err != nil {
+		return false, err
+	}
+	err = p.cur.add(hash, in)
+	in.Close()
+	if err != nil {
+		return false, fmt.Errorf("error writing pack %s: %v", p.cur.id, err)
+	}
+
+	e := p.cur.entries[len(p.cur.entries)-1]
+	p.blobs[hash] = packLocation{pack: p.cur.id, packIndexEntry: e}
+	p.packs[p.cur.id] = p.cur.entries
+
+	if p.cur.size >= packTargetSize {
+		return true, p.flushLocked()
+	}
+	return true, nil
+}
+
+// flush finishes the pack being written
+func (p *packStore) flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.flushLocked()
+}
+
+func (p *packStore) flushLocked() error {
+	if p.cur == nil {
+		return nil
+	}
+	w := p.cur
+	p.cur = nil
+	return p.finish(w)
+}
+
+// repack rewrites every pack holding files that are no longer live. Packs
+// without live files are deleted, the others are copied to a new pack with
+// only their live files. It returns the number of files dropped and the
+// bytes freed.
+func (p *packStore) repack(isLive func(hash string) bool) (int, int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.load(); err != nil {
+		return 0, 0, err
+	}
+	if err := p.flushLocked(); err != nil {
+		return 0, 0, err
+	}
+
+	ids := make([]string, 0, len(p.packs))
+	for id := range p.packs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var removed int
+	var reclaimed int64
+	for _, id := range ids {
+		var live []packIndexEntry
+		for _, e := range p.packs[id] {
+			if isLive(e.Hash) {
+				live = append(live, e)
+			}
+		}
+		dead := len(p.packs[id]) - len(live)
+		if dead == 0 {
+			continue
+		}
+
+		oldSize := int64(0)
+		if info, err := os.Stat(p.packPath(id)); err == nil {
+			oldSize = info.Size()
+		}
+
+		var repacked *packWriter
+		if len(live) > 0 {
+			fmt.Printf("Repacking Pack %s, %d of %d files left\n", id, len(live), len(p.packs[id]))
+			w, err := p.copyPack(id, live)
+			if err != nil {
+				return removed, reclaimed, err
+			}
+			repacked = w
+		} else {
+			fmt.Println("Deleteing Pack " + id)
+		}
+
+		// the old index goes first so the old pack is never used without it
+		if err := FileDelete(p.indexPath(id)); err != nil {
+			return removed, reclaimed, fmt.Errorf("error deleting pack index %s: %v", id, err)
+		}
+		if err := FileDelete(p.packPath(id)); err != nil {
+			return removed, reclaimed, fmt.Errorf("error deleting pack %s: %v", id, err)
+		}
+		p.removePack(id)
+
+		removed += dead
+		reclaimed += oldSize
+		if repacked != nil {
+			p.addPack(repacked.id, repacked.entries)
+			reclaimed -= repacked.size
+		}
+	}
+
+	return removed, reclaimed, nil
+}
+
+// copyPack writes the given files of a pack to a new pack
+func (p *packStore) copyPack(id string, entries []packIndexEntry) (*packWriter, error) {
+	in, err := os.Open(p.packPath(id))
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	w, err := p.newPackWriter()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if err := w.add(e.Hash, io.NewSectionReader(in, e.Offset, e.Length)); err != nil {
+			w.file.Close()
+			os.Remove(p.packPath(w.id))
+			return nil, fmt.Errorf("error repacking pack %s: %v", id, err)
+		}
+	}
+	if err := p.finish(w); err != nil {
+		os.Remove(p.packPath(w.id))
+		return nil, err
+	}
+	return w, nil
+}
+
+// clean removes packs without an index and leftover temp files
+func (p *packStore) clean() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	dirFiles, err := ioutil.ReadDir(p.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, df := range dirFiles {
+		name := df.Name()
+		if df.IsDir() {
+			continue
+		}
+		incomplete := strings.HasSuffix(name, packSuffix) &&
+			!fileExists(p.indexPath(strings.TrimSuffix(name, packSuffix)))
+		if incomplete || strings.HasSuffix(name, tempFileSuffix) {
+			fmt.Println("Deleteing Incomplete Pack File " + name)
+			if err := FileDelete(filepath.Join(p.dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fileExists reports whether a file exists, errors count as missing
+func fileExists(path string) bool {
+	exists, err := FileExists(path)
+	return exists && err == nil
+}
+
+// packedFileReader reads one file from a pack
+type packedFileReader struct {
+	*io.SectionReader
+	file *os.File
+}
+
+func (p *packedFileReader) Close() error {
+	return p.file.Close()
+}
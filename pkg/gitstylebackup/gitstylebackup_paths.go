@@ -0,0 +1,100 @@
+package gitstylebackup
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// comparePath cleans a path for comparison. Windows paths compare case
+// insensitive, POSIX paths keep their case.
+func comparePath(path string) string {
+	path = filepath.Clean(path)
+	if runtime.GOOS == "windows" {
+		path = strings.ToLower(path)
+	}
+	return path
+}
+
+// isExcluded reports whether path is one of the excluded paths or below one.
+// The excluded paths must already be cleaned with comparePath.
+func isExcluded(path string, excludes []string) bool {
+	normalizedPath := comparePath(path)
+	for _, ex := range excludes {
+		if normalizedPath == ex {
+			return true
+		}
+
+		// the root of a volume already ends with a separator
+		prefix := ex
+		if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+			prefix += string(filepath.Separator)
+		}
+		if strings.HasPrefix(normalizedPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isWindowsPath reports whether a path recorded in a version file was
+// written on Windows, it starts with a drive letter or a UNC prefix
+func isWindowsPath(path string) bool {
+	if strings.HasPrefix(path, `\\`) {
+		return true
+	}
+	return len(path) >= 3 && path[1] == ':' && path[2] == '\\' &&
+		((path[0] >= 'a' && path[0] <= 'z') || (path[0] >= 'A' && path[0] <= 'Z'))
+}
+
+// pathParts splits a path recorded in a version file into its elements
+// without the volume name, so paths written on Windows can be restored on
+// POSIX systems and the other way around
+func pathParts(path string) []string {
+	sep := string(filepath.Separator)
+	if isWindowsPath(path) {
+		// both a drive letter and a UNC prefix are two characters
+		sep = `\`
+		path = path[2:]
+	} else {
+		path = path[len(filepath.VolumeName(path)):]
+	}
+
+	var parts []string
+	for _, part := range strings.Split(path, sep) {
+		if part != "" && part != "." && part != ".." {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// restoreRelativePath returns where a backed up file is placed inside the
+// restore directory. With a single include path files keep their path
+// relative to it, otherwise they keep their full path without the volume name.
+func restoreRelativePath(includes []string, file string) string {
+	fileParts := pathParts(file)
+	if len(includes) == 1 {
+		includeParts := pathParts(includes[0])
+		fold := runtime.GOOS == "windows" || isWindowsPath(file)
+		if len(fileParts) > len(includeParts) && partsHavePrefix(fileParts, includeParts, fold) {
+			return filepath.Join(fileParts[len(includeParts):]...)
+		}
+	}
+	return filepath.Join(fileParts...)
+}
+
+// partsHavePrefix reports whether the path elements start with prefix,
+// fold compares them case insensitive
+func partsHavePrefix(parts []string, prefix []string, fold bool) bool {
+	for i, p := range prefix {
+		if fold {
+			if !strings.EqualFold(parts[i], p) {
+				return false
+			}
+		} else if parts[i] != p {
+			return false
+		}
+	}
+	return true
+}
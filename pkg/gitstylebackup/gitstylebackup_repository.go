@@ -0,0 +1,335 @@
+package gitstylebackup
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Repository is a backup directory opened from a Config. It owns its folder
+// paths, in-use lock and encryption key so several repositories can be used
+// at the same time in one process.
+type Repository struct {
+	cfg        Config
+	root       string
+	versionDir string
+	filesDir   string
+	packDir    string
+	inUseFile  string
+	configFile string
+	keysFile   string
+	key        []byte
+	keyID      string // slot of Keys.json unlocked by the config
+	idKey      []byte // keys the names of stored files, see newHash
+	repoCfg    RepositoryConfig
+
+	packs *packStore
+
+	mu     sync.Mutex
+	locked bool
+}
+
+// newRepository sets up the repository paths and encryption key for a config
+func newRepository(cfg Config) (*Repository, error) {
+	if cfg.BackupDir == "" {
+		return nil, errors.New("backup directory is required")
+	}
+
+	key, err := getEncryptionKey(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error getting encryption key: %v", err)
+	}
+
+	root := filepath.Clean(cfg.BackupDir)
+	packDir := filepath.Join(root, "Packs")
+	return &Repository{
+		cfg:        cfg,
+		root:       root,
+		versionDir: filepath.Join(root, "Version"),
+		filesDir:   filepath.Join(root, "Files"),
+		packDir:    packDir,
+		inUseFile:  filepath.Join(root, "InUse.txt"),
+		configFile: filepath.Join(root, repositoryConfigFileName),
+		keysFile:   filepath.Join(root, keysFileName),
+		key:        key,
+		packs:      &packStore{dir: packDir},
+	}, nil
+}
+
+// Open opens an existing backup directory and checks that its repository
+// config can be used with this program and the given key
+func Open(cfg Config) (*Repository, error) {
+	r, err := newRepository(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := FolderExists(r.versionDir)
+	if exists == false || err != nil {
+		if err != nil {
+			return nil, fmt.Errorf("%w: no version folder found: %v", ErrNotRepository, err)
+		}
+		return nil, fmt.Errorf("%w: no version folder found in %s", ErrNotRepository, r.root)
+	}
+
+	exists, err = FolderExists(r.filesDir)
+	if exists == false || err != nil {
+		if err != nil {
+			return nil, fmt.Errorf("%w: no files folder found: %v", ErrNotRepository, err)
+		}
+		return nil, fmt.Errorf("%w: no files folder found in %s", ErrNotRepository, r.root)
+	}
+
+	r.repoCfg, err = readRepositoryConfig(r.configFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s has no %s, run --migrate", ErrNeedsMigration, r.root, repositoryConfigFileName)
+		}
+		return nil, err
+	}
+	if err := r.checkConfig(); err != nil {
+		return nil, err
+	}
+
+	if cfg.ChunkSizeKB != 0 && cfg.ChunkSizeKB != r.repoCfg.ChunkSizeKB {
+		fmt.Printf("Warning: chunkSizeKB %d differs from the backup directory, using %d\n", cfg.ChunkSizeKB, r.repoCfg.ChunkSizeKB)
+	}
+
+	return r, nil
+}
+
+// checkConfig checks that the repository config can be used with this
+// program and that the key of the config is the key of the repository
+func (r *Repository) checkConfig() error {
+	if err := r.repoCfg.validate(r.key); err != nil {
+		return err
+	}
+	if err := r.unlock(); err != nil {
+		return err
+	}
+	if err := r.repoCfg.checkKey(r.key); err != nil {
+		return err
+	}
+	r.packs.key = r.key
+	if r.repoCfg.HashAlgorithm == hashHMACSHA256 {
+		r.idKey = blobIDKey(r.key)
+	}
+	return nil
+}
+
+// unlock replaces the key of the config by the master key of a repository
+// with a key file. Older encrypted repositories use the key of the config.
+func (r *Repository) unlock() error {
+	if r.repoCfg.KeyDerivation != keyFromKeysFile {
+		return nil
+	}
+	secret, err := keySecret(r.cfg)
+	if err != nil {
+		return err
+	}
+	master, id, err := unlockMasterKey(r.keysFile, secret)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s is missing from %s", ErrUnsupportedRepository, keysFileName, r.root)
+		}
+		return err
+	}
+	r.key, r.keyID = master, id
+	return nil
+}
+
+// Init creates a new backup directory with its repository config and opens
+// it. An existing backup directory is opened instead.
+func Init(cfg Config) (*Repository, error) {
+	r, err := newRepository(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if exists, _ := FileExists(r.configFile); exists {
+		return Open(cfg)
+	}
+	// a version folder with versions but no config was written by an older release
+	if versions, err := ioutil.ReadDir(r.versionDir); err == nil && len(versions) > 0 {
+		return nil, fmt.Errorf("%w: %s has no %s, run --migrate", ErrNeedsMigration, r.root, repositoryConfigFileName)
+	}
+
+	// Create backup directory if it doesn't exist
+	if err := os.MkdirAll(r.root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %v", err)
+	}
+
+	// Create version directory if it doesn't exist
+	if err := os.MkdirAll(r.versionDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create version directory: %v", err)
+	}
+
+	// Create files directory if it doesn't exist
+	if err := os.MkdirAll(r.filesDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create files directory: %v", err)
+	}
+
+	// Create pack directory if it doesn't exist
+	if err := os.MkdirAll(r.packDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create pack directory: %v", err)
+	}
+
+	// The repository config is needed to know the hash and shard folders
+	r.repoCfg, err = newRepositoryConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// The password of an encrypted repository unlocks a random master key
+	if r.repoCfg.KeyDerivation == keyFromKeysFile {
+		master, err := createKeysFile(r.keysFile, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s: %v", keysFileName, err)
+		}
+		r.repoCfg.KeyCheck = keyCheck(master, r.repoCfg.ID)
+	}
+
+	// Create the first level of shard folders, deeper levels are made when used
+	var shards []string
+	if r.repoCfg.HashAlgorithm == hashSHA1 {
+		for i := 0; i <= 25; i++ {
+			shards = append(shards, fmt.Sprintf("%02d", i))
+		}
+	} else {
+		for i := 0; i < 256; i++ {
+			shards = append(shards, fmt.Sprintf("%02x", i))
+		}
+	}
+	for _, shard := range shards {
+		subdir := filepath.Join(r.filesDir, shard)
+		if err := os.MkdirAll(subdir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create subfiles directory %s: %v", subdir, err)
+		}
+	}
+
+	// The repository config is written last, it marks the directory complete
+	if err := writeRepositoryConfig(r.configFile, r.repoCfg); err != nil {
+		return nil, fmt.Errorf("failed to write repository config: %v", err)
+	}
+
+	// another process may have created the directory at the same time
+	return Open(cfg)
+}
+
+// Config returns the repository config of the backup directory
+func (r *Repository) Config() RepositoryConfig {
+	return r.repoCfg
+}
+
+// Dir returns the root folder of the repository
+func (r *Repository) Dir() string {
+	return r.root
+}
+
+// Lock marks the repository in use. It fails if another process or
+// Repository already holds the lock.
+func (r *Repository) Lock() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.locked {
+		return ErrRepositoryInUse
+	}
+
+	// O_EXCL makes checking and creating the in-use file a single step
+	f, err := os.OpenFile(r.inUseFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return ErrRepositoryInUse
+		}
+		return fmt.Errorf("failed to create in-use file: %v", err)
+	}
+	f.Close()
+
+	// packs written or repacked by others while the lock was free
+	r.packs.hold(true)
+	r.locked = true
+	return nil
+}
+
+// Unlock removes the in-use mark set by Lock
+func (r *Repository) Unlock() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.locked {
+		return nil
+	}
+	r.locked = false
+	r.packs.hold(false)
+
+	if err := FileDelete(r.inUseFile); err != nil {
+		return fmt.Errorf("failed to remove in-use file: %v", err)
+	}
+	return nil
+}
+
+// Versions returns the versions in the repository from oldest to newest
+func (r *Repository) Versions() ([]string, error) {
+	verDirFile, err := ioutil.ReadDir(r.versionDir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading version files: %v", err)
+	}
+
+	var versions []string
+	for _, verDF := range verDirFile {
+		if verDF.IsDir() || strings.HasSuffix(verDF.Name(), tempFileSuffix) {
+			continue
+		}
+
+		if !validVersionID(verDF.Name()) {
+			return nil, fmt.Errorf("%w: unexpected file %s in version folder", ErrCorruptManifest, verDF.Name())
+		}
+		versions = append(versions, verDF.Name())
+	}
+
+	sortVersions(versions)
+	return versions, nil
+}
+
+// latestVersion returns the newest version, empty when there are none
+func (r *Repository) latestVersion() (string, error) {
+	versions, err := r.Versions()
+	if err != nil || len(versions) == 0 {
+		return "", err
+	}
+	return versions[len(versions)-1], nil
+}
+
+// cleanTempVersions removes version files left behind by an interrupted backup
+func (r *Repository) cleanTempVersions() error {
+	verDirFile, err := ioutil.ReadDir(r.versionDir)
+	if err != nil {
+		return fmt.Errorf("error reading version files: %v", err)
+	}
+
+	for _, verDF := range verDirFile {
+		if !verDF.IsDir() && strings.HasSuffix(verDF.Name(), tempFileSuffix) {
+			if err := FileDelete(filepath.Join(r.versionDir, verDF.Name())); err != nil {
+				return fmt.Errorf("error cleaning up temp version %s: %v", verDF.Name(), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// versionFile returns the path of a version file
+func (r *Repository) versionFile(version string) string {
+	return filepath.Join(r.versionDir, version)
+}
+
+// blobFile returns the path of a stored file from its hash
+func (r *Repository) blobFile(hash string) string {
+	parts := append([]string{r.filesDir}, r.shardDirs(hash)...)
+	return filepath.Join(append(parts, hash)...)
+}
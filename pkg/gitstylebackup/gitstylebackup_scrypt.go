@@ -0,0 +1,150 @@
+package gitstylebackup
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// scrypt (RFC 7914) derives the key unlocking the repository key from a
+// password. Its cost in time and memory is set by n, 128*r*n bytes are used,
+// which makes guessing passwords expensive even with special hardware.
+func scrypt(password, salt []byte, n, r, p, keyLen int) ([]byte, error) {
+	if n <= 1 || n&(n-1) != 0 {
+		return nil, errors.New("scrypt: n must be a power of 2 greater than 1")
+	}
+	if r <= 0 || p <= 0 || uint64(r)*uint64(p) >= 1<<30 || r > maxInt/128/p || r > maxInt/256 || n > maxInt/128/r {
+		return nil, errors.New("scrypt: parameters are too large")
+	}
+
+	xy := make([]uint32, 64*r)
+	v := make([]uint32, 32*n*r)
+	b := pbkdf2SHA256(password, salt, 1, p*128*r)
+	for i := 0; i < p; i++ {
+		scryptROMix(b[i*128*r:], r, n, v, xy)
+	}
+	return pbkdf2SHA256(password, b, 1, keyLen), nil
+}
+
+const maxInt = int(^uint(0) >> 1)
+
+// pbkdf2SHA256 is PBKDF2 (RFC 8018) with HMAC-SHA256
+func pbkdf2SHA256(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	size := prf.Size()
+	blocks := (keyLen + size - 1) / size
+
+	var counter [4]byte
+	dk := make([]byte, 0, blocks*size)
+	u := make([]byte, size)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter[:], uint32(block))
+		prf.Write(counter[:])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-size:]
+		copy(u, t)
+
+		for i := 2; i <= iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range u {
+				t[j] ^= u[j]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
+
+// scryptROMix mixes one block of 128*r bytes of b in place, v holds the n
+// earlier states looked up in random order
+func scryptROMix(b []byte, r, n int, v, xy []uint32) {
+	var tmp [16]uint32
+	size := 32 * r
+	x := xy[:size]
+	y := xy[size:]
+
+	for i := range x {
+		x[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+	for i := 0; i < n; i += 2 {
+		copy(v[i*size:], x)
+		scryptBlockMix(&tmp, x, y, r)
+		copy(v[(i+1)*size:], y)
+		scryptBlockMix(&tmp, y, x, r)
+	}
+	for i := 0; i < n; i += 2 {
+		j := scryptIntegerify(x, r) & uint64(n-1)
+		xorWords(x, v[int(j)*size:])
+		scryptBlockMix(&tmp, x, y, r)
+
+		j = scryptIntegerify(y, r) & uint64(n-1)
+		xorWords(y, v[int(j)*size:])
+		scryptBlockMix(&tmp, y, x, r)
+	}
+	for i, w := range x {
+		binary.LittleEndian.PutUint32(b[4*i:], w)
+	}
+}
+
+// scryptBlockMix runs salsa20/8 over the 2*r 64 byte blocks of in, writing
+// the even results to the first half of out and the odd ones to the second
+func scryptBlockMix(tmp *[16]uint32, in, out []uint32, r int) {
+	copy(tmp[:], in[(2*r-1)*16:])
+	for i := 0; i < 2*r; i += 2 {
+		salsa208XOR(tmp, in[i*16:], out[i*8:])
+		salsa208XOR(tmp, in[i*16+16:], out[i*8+r*16:])
+	}
+}
+
+// scryptIntegerify reads the first 8 bytes of the last 64 byte block
+func scryptIntegerify(b []uint32, r int) uint64 {
+	j := (2*r - 1) * 16
+	return uint64(b[j]) | uint64(b[j+1])<<32
+}
+
+func xorWords(dst, src []uint32) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+// salsa208XOR sets tmp and out to the salsa20/8 core of tmp xor in
+func salsa208XOR(tmp *[16]uint32, in, out []uint32) {
+	var w [16]uint32
+	for i := range w {
+		w[i] = tmp[i] ^ in[i]
+	}
+
+	x := w
+	for i := 0; i < 8; i += 2 {
+		// columns
+		x[0], x[4], x[8], x[12] = salsaQuarterRound(x[0], x[4], x[8], x[12])
+		x[5], x[9], x[13], x[1] = salsaQuarterRound(x[5], x[9], x[13], x[1])
+		x[10], x[14], x[2], x[6] = salsaQuarterRound(x[10], x[14], x[2], x[6])
+		x[15], x[3], x[7], x[11] = salsaQuarterRound(x[15], x[3], x[7], x[11])
+		// rows
+		x[0], x[1], x[2], x[3] = salsaQuarterRound(x[0], x[1], x[2], x[3])
+		x[5], x[6], x[7], x[4] = salsaQuarterRound(x[5], x[6], x[7], x[4])
+		x[10], x[11], x[8], x[9] = salsaQuarterRound(x[10], x[11], x[8], x[9])
+		x[15], x[12], x[13], x[14] = salsaQuarterRound(x[15], x[12], x[13], x[14])
+	}
+
+	for i := range w {
+		w[i] += x[i]
+		tmp[i] = w[i]
+		out[i] = w[i]
+	}
+}
+
+func salsaQuarterRound(a, b, c, d uint32) (uint32, uint32, uint32, uint32) {
+	b ^= bits.RotateLeft32(a+d, 7)
+	c ^= bits.RotateLeft32(b+a, 9)
+	d ^= bits.RotateLeft32(c+b, 13)
+	a ^= bits.RotateLeft32(d+c, 18)
+	return a, b, c, d
+}
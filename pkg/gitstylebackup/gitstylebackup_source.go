@@ -0,0 +1,55 @@
+package gitstylebackup
+
+// Several machines may back up to one backup directory. Version names are
+// unique in the whole directory and stored files are shared by all of them,
+// but each machine, or each configured source name, has its own stream of
+// versions: the newest version, listing and trim "+x" only look at the
+// versions of the source doing the work.
+
+// source returns the name of the version stream this repository works on
+func (r *Repository) source() string {
+	if r.cfg.Source != "" {
+		return r.cfg.Source
+	}
+	return hostName()
+}
+
+// source returns the version stream a version belongs to. Versions written
+// before sources existed use the host they ran on, and belong to every
+// source when that is unknown as well.
+func (h ManifestHeader) source() string {
+	if h.Source != "" {
+		return h.Source
+	}
+	return h.Host
+}
+
+// inSource reports whether a version belongs to the stream source
+func (h ManifestHeader) inSource(source string) bool {
+	s := h.source()
+	return s == "" || s == source
+}
+
+// sourceVersions returns the versions of this repository's source from
+// oldest to newest
+func (r *Repository) sourceVersions() ([]string, error) {
+	headers, err := r.ListVersions()
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]string, 0, len(headers))
+	for _, h := range headers {
+		versions = append(versions, h.Version)
+	}
+	return versions, nil
+}
+
+// latestSourceVersion returns the newest version of this repository's source,
+// empty when it has none
+func (r *Repository) latestSourceVersion() (string, error) {
+	versions, err := r.sourceVersions()
+	if err != nil || len(versions) == 0 {
+		return "", err
+	}
+	return versions[len(versions)-1], nil
+}
@@ -7,8 +7,9 @@ import (
 	"time"
 )
 
-// saveRestoreState saves the restore state to a JSON file
-func saveRestoreState(stateFile string, state RestoreState) error {
+// saveRestoreState saves the restore state to a JSON file, encrypted with
+// key when given since it lists the restored paths
+func saveRestoreState(stateFile string, key []byte, state RestoreState) error {
 	state.LastUpdate = time.Now().Format(timeFormat)
 	
 	data, err := json.MarshalIndent(state, "", "  ")
@@ -16,7 +17,11 @@ func saveRestoreState(stateFile string, state RestoreState) error {
 		return fmt.Errorf("failed to marshal restore state: %v", err)
 	}
 	
-	err = ioutil.WriteFile(stateFile, data, 0644)
+	if key == nil {
+		err = ioutil.WriteFile(stateFile, data, 0644)
+	} else {
+		err = writeSealedFile(stateFile, key, data)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to write restore state file: %v", err)
 	}
@@ -25,10 +30,10 @@ func saveRestoreState(stateFile string, state RestoreState) error {
 }
 
 // loadRestoreState loads the restore state from a JSON file
-func loadRestoreState(stateFile string) (RestoreState, error) {
+func loadRestoreState(stateFile string, key []byte) (RestoreState, error) {
 	var state RestoreState
 	
-	data, err := ioutil.ReadFile(stateFile)
+	data, err := readSealedFile(stateFile, key)
 	if err != nil {
 		return state, fmt.Errorf("failed to read restore state file: %v", err)
 	}
@@ -0,0 +1,289 @@
+package gitstylebackup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// storeAttempts is how often a file that changes while it is read is stored
+// before it is recorded with the Changed flag
+const storeAttempts = 3
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// storeFile stores a source file as a blob and returns its version file entry.
+// stored is the number of new blobs written, 0 when existing ones were reused.
+func (r *Repository) storeFile(path string) (entry ManifestEntry, stored int, err error) {
+	for attempt := 1; ; attempt++ {
+		last := attempt == storeAttempts
+		entry, stored, err = r.storeFileOnce(path, last)
+		if err != nil || !entry.Changed || last {
+			return entry, stored, err
+		}
+		fmt.Printf("File changed while reading, retrying: %s\n", path)
+	}
+}
+
+// storeFileOnce reads a source file once, hashing it while it is compressed to
+// a temporary blob, and then names the blob by that hash. Large files are
+// split into chunks instead when chunking is enabled. The blob always
+// matches its name, but when the file changed during the read its entry is
+// marked Changed and, unless keep is set, the blob is discarded.
+func (r *Repository) storeFileOnce(path string, keep bool) (ManifestEntry, int, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return ManifestEntry{}, 0, err
+	}
+	defer in.Close()
+
+	before, err := in.Stat()
+	if err != nil {
+		return ManifestEntry{}, 0, err
+	}
+
+	hasher := r.newHash()
+	counter := &countingWriter{}
+	src := io.TeeReader(in, io.MultiWriter(hasher, counter))
+
+	var chunks []string
+	var chunksStored int
+	var tmpName string
+	chunkSize := r.chunkSize()
+	if chunkSize > 0 && before.Size() > int64(chunkSize)*4 {
+		chunks, chunksStored, err = r.storeChunks(src, chunkSize)
+	} else {
+		tmpName, err = r.writeTempBlob(src)
+		defer os.Remove(tmpName) // no-op once the blob has been renamed
+	}
+	if err != nil {
+		return ManifestEntry{}, 0, err
+	}
+
+	after, err := os.Stat(path)
+	if err != nil {
+		return ManifestEntry{}, 0, err
+	}
+
+	entry := ManifestEntry{
+		Path:    path,
+		ModTime: before.ModTime(),
+		Size:    counter.n,
+		Hash:    r.hashName(hasher.Sum(nil)),
+		Chunks:  chunks,
+	}
+	entry.Inode, entry.ChangeTime = fileIdentity(before)
+	entry.Changed = counter.n != before.Size() || after.Size() != before.Size() ||
+		!after.ModTime().Equal(before.ModTime())
+	if chunks != nil || (entry.Changed && !keep) {
+		return entry, chunksStored, nil
+	}
+
+	stored, err := r.putBlob(entry.Hash, tmpName)
+	if err != nil || !stored {
+		return entry, 0, err
+	}
+	return entry, 1, nil
+}
+
+// writeTempBlob compresses and encrypts src to a temporary file in the files
+// folder and returns its name
+func (r *Repository) writeTempBlob(src io.Reader) (string, error) {
+	tmp, err := os.CreateTemp(r.filesDir, "blob.*"+tempFileSuffix)
+	if err != nil {
+		return "", fmt.Errorf("error creating temp file: %v", err)
+	}
+
+	err = gzipAndEncrypt(tmp, src, r.key)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// chunkSize returns the average chunk size in bytes, 0 when chunking is off
+func (r *Repository) chunkSize() int {
+	return r.repoCfg.ChunkSizeKB * 1024
+}
+
+// storeChunks splits src into content defined chunks and stores each chunk as
+// a blob. It returns the chunk hashes in order and how many chunks were new.
+func (r *Repository) storeChunks(src io.Reader, chunkSize int) ([]string, int, error) {
+	var hashes []string
+	var newChunks int
+
+	c := newChunker(src, chunkSize)
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		hash, stored, err := r.storeBlob(chunk)
+		if err != nil {
+			return nil, 0, err
+		}
+		hashes = append(hashes, hash)
+		if stored {
+			newChunks++
+		}
+	}
+
+	// an empty chunk list would read as an unchunked entry
+	if len(hashes) == 0 {
+		hash, stored, err := r.storeBlob(nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		hashes = append(hashes, hash)
+		if stored {
+			newChunks++
+		}
+	}
+	return hashes, newChunks, nil
+}
+
+// storeBlob stores data as a blob named by its hash unless it already exists
+func (r *Repository) storeBlob(data []byte) (string, bool, error) {
+	hash := r.hashData(data)
+
+	exists, err := r.hasBlob(hash)
+	if err != nil || exists {
+		return hash, false, err
+	}
+
+	tmpName, err := r.writeTempBlob(bytes.NewReader(data))
+	if err != nil {
+		return "", false, err
+	}
+	defer os.Remove(tmpName)
+
+	stored, err := r.putBlob(hash, tmpName)
+	if err != nil {
+		return "", false, err
+	}
+	return hash, stored, nil
+}
+
+// hasBlob reports whether a stored file exists, loose or in a pack
+func (r *Repository) hasBlob(hash string) (bool, error) {
+	exists, err := FileExists(r.blobFile(hash))
+	if err != nil || exists {
+		return exists, err
+	}
+	_, packed, err := r.packs.lookup(hash)
+	return packed, err
+}
+
+// blobsExist reports whether all the stored files exist
+func (r *Repository) blobsExist(hashes []string) bool {
+	for _, hash := range hashes {
+		if exists, err := r.hasBlob(hash); !exists || err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// putBlob moves a complete temporary stored file into the repository under
+// its hash. Small files are appended to a pack, large ones are renamed into
+// their folder. It reports false when the file was already stored.
+func (r *Repository) putBlob(hash, tmpName string) (bool, error) {
+	exists, err := r.hasBlob(hash)
+	if err != nil || exists {
+		return false, err
+	}
+
+	info, err := os.Stat(tmpName)
+	if err != nil {
+		return false, err
+	}
+	if info.Size() <= packBlobLimit {
+		return r.packs.put(hash, tmpName)
+	}
+
+	blobPath := r.blobFile(hash)
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmpName, blobPath); err != nil {
+		return false, err
+	}
+	// the temp file is in the files folder, the blob in its hash folder
+	if err := syncDir(filepath.Dir(blobPath)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// openBlob opens the stored bytes of a file, loose or from its pack
+func (r *Repository) openBlob(hash string) (io.ReadCloser, error) {
+	blobPath := r.blobFile(hash)
+	f, err := os.Open(blobPath)
+	if err == nil || !os.IsNotExist(err) {
+		return f, err
+	}
+
+	loc, packed, lerr := r.packs.lookup(hash)
+	if lerr != nil {
+		return nil, lerr
+	}
+	if !packed {
+		return nil, err
+	}
+
+	pack, err := os.Open(r.packs.packPath(loc.pack))
+	if os.IsNotExist(err) {
+		// another process repacked the file since the indexes were read
+		if loc, packed, lerr = r.packs.relookup(hash); lerr != nil {
+			return nil, lerr
+		}
+		if packed {
+			pack, err = os.Open(r.packs.packPath(loc.pack))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &packedFileReader{SectionReader: io.NewSectionReader(pack, loc.Offset, loc.Length), file: pack}, nil
+}
+
+// hashBlob hashes the original content of a stored file
+func (r *Repository) hashBlob(hash string) ([]byte, error) {
+	raw, err := r.openBlob(hash)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	in, err := newStoredFileReader(raw, r.key)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer in.Close()
+
+	hasher := r.newHash()
+	if _, err = io.Copy(hasher, in); err != nil {
+		return []byte{}, err
+	}
+	return hasher.Sum(nil), nil
+}
@@ -0,0 +1,288 @@
+package gitstylebackup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Encrypted files are written as a stream of segments so that files of any
+// size are encrypted and decrypted in constant memory. The stream starts with
+// a header
+//
+//	magic (8 bytes) | segment size (4 bytes, big endian) | salt (32 bytes)
+//
+// followed by segments of segment size bytes of compressed content, the last
+// one shorter or empty, each sealed with AES-GCM. Every stream has its own
+// key derived from the repository key and the salt, and every segment its own
+// nonce made of its number and a flag marking the last segment, so segments
+// cannot be reordered, dropped or cut off without failing authentication.
+// The header is authenticated with every segment.
+//
+// Files encrypted before streams existed are a nonce followed by the whole
+// compressed content sealed at once and are still read.
+const (
+	streamMagic          = "GSBAEAD1"
+	streamSaltSize       = 32
+	streamHeaderSize     = len(streamMagic) + 4 + streamSaltSize
+	streamSegmentSize    = 64 * 1024
+	maxStreamSegmentSize = 16 * 1024 * 1024 // limits what a damaged header can make a reader allocate
+)
+
+// errNotAuthentic is wrapped in the errors of encrypted data failing
+// authentication. The key of a backup directory is checked when it is opened,
+// so this means damaged data, only while a key is checked a wrong key.
+var errNotAuthentic = errors.New("authentication failed")
+
+// streamCipher seals and opens the segments of one stream
+type streamCipher struct {
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	seq    uint64
+}
+
+func newStreamCipher(key, header []byte) (*streamCipher, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(header[len(header)-streamSaltSize:])
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &streamCipher{aead: aead, header: header, nonce: make([]byte, aead.NonceSize())}, nil
+}
+
+// nextNonce returns the nonce of the next segment
+func (s *streamCipher) nextNonce(last bool) []byte {
+	binary.BigEndian.PutUint64(s.nonce[len(s.nonce)-9:], s.seq)
+	s.nonce[len(s.nonce)-1] = 0
+	if last {
+		s.nonce[len(s.nonce)-1] = 1
+	}
+	s.seq++
+	return s.nonce
+}
+
+// encryptWriter encrypts what is written to it as a stream of segments
+type encryptWriter struct {
+	out    io.Writer
+	cipher *streamCipher
+	buf    []byte // content of the segment being filled
+	sealed []byte
+	closed bool
+}
+
+// newEncryptWriter writes the stream header to out and returns a writer
+// encrypting into it. Close must be called to write the last segment.
+func newEncryptWriter(out io.Writer, key []byte) (io.WriteCloser, error) {
+	header := make([]byte, streamHeaderSize)
+	copy(header, streamMagic)
+	binary.BigEndian.PutUint32(header[len(streamMagic):], streamSegmentSize)
+	if _, err := io.ReadFull(rand.Reader, header[len(streamMagic)+4:]); err != nil {
+		return nil, err
+	}
+
+	sc, err := newStreamCipher(key, header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := out.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{out: out, cipher: sc, buf: make([]byte, 0, streamSegmentSize)}, nil
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// a full segment is only sealed once more content shows it is not the last
+		if len(w.buf) == streamSegmentSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the last segment, it does not close the underlying writer
+func (w *encryptWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.seal(true)
+}
+
+func (w *encryptWriter) seal(last bool) error {
+	w.sealed = w.cipher.aead.Seal(w.sealed[:0], w.cipher.nextNonce(last), w.buf, w.cipher.header)
+	w.buf = w.buf[:0]
+	_, err := w.out.Write(w.sealed)
+	return err
+}
+
+// decryptReader reads the content of a stream of segments
+type decryptReader struct {
+	in      io.Reader
+	corrupt error // reported for a damaged stream
+	cipher  *streamCipher
+	sealed  []byte
+	plain   []byte // opened content not read yet
+	pending []byte // first byte of the next segment, read to find the last one
+	done    bool
+	err     error
+}
+
+// isStream reports whether stored bytes start with a stream header
+func isStream(prefix []byte) bool {
+	return bytes.HasPrefix(prefix, []byte(streamMagic))
+}
+
+// newDecryptReader reads the stream header from in and returns a reader of
+// the decrypted content. A damaged stream, also a segment failing
+// authentication, is reported as corrupt, ErrBlobCorrupt for stored files.
+func newDecryptReader(in io.Reader, key []byte, corrupt error) (io.Reader, error) {
+	header := make([]byte, streamHeaderSize)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return nil, fmt.Errorf("%w: encrypted stream header: %v", corrupt, err)
+	}
+	if !isStream(header) {
+		return nil, fmt.Errorf("%w: not an encrypted stream", corrupt)
+	}
+	size := binary.BigEndian.Uint32(header[len(streamMagic):])
+	if size == 0 || size > maxStreamSegmentSize {
+		return nil, fmt.Errorf("%w: encrypted stream segment size %d", corrupt, size)
+	}
+
+	sc, err := newStreamCipher(key, header)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{in: in, corrupt: corrupt, cipher: sc, sealed: make([]byte, int(size)+sc.aead.Overhead()+1)}, nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.err = r.open()
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// open reads and opens the next segment. One byte more than a full segment
+// is read, a segment followed by nothing is the last one.
+func (r *decryptReader) open() error {
+	buf := r.sealed[:copy(r.sealed, r.pending)]
+	n, err := io.ReadFull(r.in, r.sealed[len(buf):])
+	buf = r.sealed[:len(buf)+n]
+	last := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !last {
+		return err
+	}
+
+	r.pending = nil
+	if !last {
+		r.pending = []byte{buf[len(buf)-1]}
+		buf = buf[:len(buf)-1]
+	}
+
+	seq := r.cipher.seq
+	plain, err := r.cipher.aead.Open(buf[:0], r.cipher.nextNonce(last), buf, r.cipher.header)
+	if err != nil {
+		// damaged or cut off data, or a wrong key while the key is checked
+		return fmt.Errorf("%w: encrypted segment %d: %w", r.corrupt, seq, errNotAuthentic)
+	}
+	r.plain = plain
+	r.done = last
+	return nil
+}
+
+// Version files, pack indexes and restore state list paths and sizes, in an
+// encrypted backup directory they are written as streams too. A key given
+// means a file has to be encrypted, so files of one kind cannot be swapped
+// for files of the other.
+
+// nopWriteCloser writes files of backup directories that are not encrypted
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newSealedWriter returns a writer encrypting into out when key is given.
+// Close must be called to finish the file, it does not close out.
+func newSealedWriter(out io.Writer, key []byte) (io.WriteCloser, error) {
+	if key == nil {
+		return nopWriteCloser{out}, nil
+	}
+	return newEncryptWriter(out, key)
+}
+
+// newSealedReader returns the content of a file written by newSealedWriter
+func newSealedReader(in io.Reader, key []byte) (io.Reader, error) {
+	br := bufio.NewReader(in)
+	prefix, _ := br.Peek(len(streamMagic))
+	switch {
+	case isStream(prefix) && key != nil:
+		return newDecryptReader(br, key, ErrCorruptManifest)
+	case isStream(prefix):
+		return nil, fmt.Errorf("%w: file is encrypted but no encryption key was given", ErrWrongKey)
+	case key != nil:
+		return nil, fmt.Errorf("%w: file is not encrypted in an encrypted backup directory", ErrCorruptManifest)
+	}
+	return br, nil
+}
+
+// readSealedFile reads a whole file written by writeSealedFile
+func readSealedFile(path string, key []byte) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	in, err := newSealedReader(f, key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(in)
+}
+
+// writeSealedFile replaces path with data, encrypted when key is given
+func writeSealedFile(path string, key []byte, data []byte) error {
+	return writeFileAtomic(path, func(out io.Writer) error {
+		w, err := newSealedWriter(out, key)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		return w.Close()
+	})
+}
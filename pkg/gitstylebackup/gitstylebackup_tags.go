@@ -0,0 +1,195 @@
+package gitstylebackup
+
+import (
+	"fmt"
+	"os"
+)
+
+// Tag attaches names to a version of a backup directory
+func Tag(cfg Config, version string, names ...string) error {
+	r, err := Open(cfg)
+	if err != nil {
+		return err
+	}
+	return r.Tag(version, names...)
+}
+
+// Untag removes tags from the versions that have them
+func Untag(cfg Config, names ...string) error {
+	r, err := Open(cfg)
+	if err != nil {
+		return err
+	}
+	return r.Untag(names...)
+}
+
+// Pin protects a version of a backup directory from trim without naming it
+func Pin(cfg Config, version string) error {
+	r, err := Open(cfg)
+	if err != nil {
+		return err
+	}
+	return r.Pin(version, true)
+}
+
+// Unpin removes the protection added by Pin
+func Unpin(cfg Config, version string) error {
+	r, err := Open(cfg)
+	if err != nil {
+		return err
+	}
+	return r.Pin(version, false)
+}
+
+// Tag attaches names to a version. A tag names a single version, so a name
+// already used by another version has to be removed with Untag first.
+func (r *Repository) Tag(version string, names ...string) error {
+	for _, name := range names {
+		if err := checkTagName(name); err != nil {
+			return err
+		}
+	}
+
+	if err := r.Lock(); err != nil {
+		return err
+	}
+	defer r.Unlock()
+
+	ver, err := r.resolveVersion(version)
+	if err != nil {
+		return err
+	}
+	if err := r.checkTagsFree(ver, names); err != nil {
+		return err
+	}
+
+	return r.rewriteVersionHeader(ver, func(h *ManifestHeader) {
+		for _, name := range names {
+			if !containsString(h.Tags, name) {
+				h.Tags = append(h.Tags, name)
+			}
+		}
+	})
+}
+
+// Untag removes tags from the versions that have them
+func (r *Repository) Untag(names ...string) error {
+	if err := r.Lock(); err != nil {
+		return err
+	}
+	defer r.Unlock()
+
+	for _, name := range names {
+		ver, found, err := r.findTag(name)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("%w: no version is tagged %q", ErrVersionNotFound, name)
+		}
+
+		err = r.rewriteVersionHeader(ver, func(h *ManifestHeader) {
+			var kept []string
+			for _, tag := range h.Tags {
+				if tag != name {
+					kept = append(kept, tag)
+				}
+			}
+			h.Tags = kept
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pin sets or clears the pin of a version, a pinned version is kept by trim
+func (r *Repository) Pin(version string, pinned bool) error {
+	if err := r.Lock(); err != nil {
+		return err
+	}
+	defer r.Unlock()
+
+	ver, err := r.resolveVersion(version)
+	if err != nil {
+		return err
+	}
+	return r.rewriteVersionHeader(ver, func(h *ManifestHeader) {
+		h.Pinned = pinned
+	})
+}
+
+// findTag returns the version with a tag, tags are shared by all sources
+func (r *Repository) findTag(name string) (string, bool, error) {
+	headers, err := r.ListAllVersions()
+	if err != nil {
+		return "", false, err
+	}
+	for _, h := range headers {
+		if containsString(h.Tags, name) {
+			return h.Version, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// checkTagsFree fails when one of the names tags a version other than ver
+func (r *Repository) checkTagsFree(ver string, names []string) error {
+	for _, name := range names {
+		other, found, err := r.findTag(name)
+		if err != nil {
+			return err
+		}
+		if found && other != ver {
+			return fmt.Errorf("tag %q is already on version %s, untag it first", name, other)
+		}
+	}
+	return nil
+}
+
+// protected reports whether trim has to keep a version for its tags or pin
+func (h ManifestHeader) protected() bool {
+	return h.Pinned || len(h.Tags) > 0
+}
+
+// rewriteVersionHeader changes the header of a version file and writes it
+// again in the current format. The new file replaces the old one in a single
+// rename, so the version is never lost. The caller must hold the lock.
+func (r *Repository) rewriteVersionHeader(version string, change func(*ManifestHeader)) error {
+	path := r.versionFile(version)
+
+	var entries []ManifestEntry
+	header, err := readManifestFile(path, r.key, func(e ManifestEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: version %s", ErrVersionNotFound, version)
+		}
+		return fmt.Errorf("error reading version file %s: %w", version, err)
+	}
+
+	change(&header)
+
+	tmpPath := path + tempFileSuffix
+	if err := writeVersionFile(tmpPath, r.key, header, entries); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("error renaming version file: %v", err)
+	}
+	return syncDir(r.versionDir)
+}
+
+// containsString reports whether list holds s
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
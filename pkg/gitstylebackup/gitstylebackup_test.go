@@ -1,11 +1,19 @@
 package gitstylebackup
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 // TestEncryptionKeyDerivation tests password and key file encryption key generation
@@ -85,6 +93,200 @@ func TestEncryptDecryptData(t *testing.T) {
 	}
 }
 
+// TestDecryptWrongKey tests that data not opening with a key fails
+// authentication and is reported as corrupt, keys are checked before
+func TestDecryptWrongKey(t *testing.T) {
+	encryptedData, err := encryptData([]byte("secret data"), deriveKey("right-password"))
+	if err != nil {
+		t.Fatalf("Failed to encrypt data: %v", err)
+	}
+
+	_, err = decryptData(encryptedData, deriveKey("wrong-password"))
+	if !errors.Is(err, ErrBlobCorrupt) || !errors.Is(err, errNotAuthentic) {
+		t.Errorf("Expected ErrBlobCorrupt failing authentication, got %v", err)
+	}
+}
+
+// TestEncryptStream tests segmented encryption round trips and detects
+// reordered, cut off and wrongly keyed streams
+func TestEncryptStream(t *testing.T) {
+	key := deriveKey("stream-password")
+	encrypt := func(data []byte) []byte {
+		var buf bytes.Buffer
+		w, err := newEncryptWriter(&buf, key)
+		if err != nil {
+			t.Fatalf("Failed to start stream: %v", err)
+		}
+		// odd write sizes cross segment boundaries
+		for len(data) > 0 {
+			n := 7777
+			if n > len(data) {
+				n = len(data)
+			}
+			if _, err := w.Write(data[:n]); err != nil {
+				t.Fatalf("Failed to write stream: %v", err)
+			}
+			data = data[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Failed to close stream: %v", err)
+		}
+		return buf.Bytes()
+	}
+	decrypt := func(sealed []byte, key []byte) ([]byte, error) {
+		r, err := newDecryptReader(bytes.NewReader(sealed), key, ErrBlobCorrupt)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	}
+
+	overhead := 16
+	for _, size := range []int{0, 1, streamSegmentSize - 1, streamSegmentSize, streamSegmentSize + 1, 3*streamSegmentSize + 5} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 31)
+		}
+		sealed := encrypt(data)
+		segments := size/streamSegmentSize + 1
+		if size > 0 && size%streamSegmentSize == 0 {
+			segments--
+		}
+		if len(sealed) != streamHeaderSize+size+segments*overhead {
+			t.Errorf("Stream of %d bytes should have %d segments, got %d bytes", size, segments, len(sealed))
+		}
+		got, err := decrypt(sealed, key)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("Stream of %d bytes did not round trip: %v", size, err)
+		}
+	}
+
+	data := bytes.Repeat([]byte("segment "), streamSegmentSize/2)
+	sealed := encrypt(data)
+	segment := streamSegmentSize + overhead
+
+	if _, err := decrypt(sealed, deriveKey("wrong-password")); !errors.Is(err, ErrBlobCorrupt) || !errors.Is(err, errNotAuthentic) {
+		t.Errorf("Expected ErrBlobCorrupt failing authentication for a wrong key, got %v", err)
+	}
+	if _, err := decrypt(sealed[:streamHeaderSize+segment], key); err == nil {
+		t.Errorf("A stream cut off after a full segment should fail")
+	}
+	swapped := append([]byte{}, sealed[:streamHeaderSize]...)
+	swapped = append(swapped, sealed[streamHeaderSize+segment:streamHeaderSize+2*segment]...)
+	swapped = append(swapped, sealed[streamHeaderSize:streamHeaderSize+segment]...)
+	swapped = append(swapped, sealed[streamHeaderSize+2*segment:]...)
+	if _, err := decrypt(swapped, key); err == nil {
+		t.Errorf("A stream with reordered segments should fail")
+	}
+	if _, err := decrypt(sealed[:10], key); !errors.Is(err, ErrBlobCorrupt) {
+		t.Errorf("Expected ErrBlobCorrupt for a cut off header, got %v", err)
+	}
+}
+
+// TestReadSingleShotBlob tests that files encrypted at once before streams stay readable
+func TestReadSingleShotBlob(t *testing.T) {
+	key := deriveKey("old-password")
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("written by an older version"))
+	gz.Close()
+	sealed, err := encryptData(compressed.Bytes(), key)
+	if err != nil {
+		t.Fatalf("Failed to encrypt data: %v", err)
+	}
+
+	in, err := newStoredFileReader(ioutil.NopCloser(bytes.NewReader(sealed)), key)
+	if err != nil {
+		t.Fatalf("Failed to open single shot blob: %v", err)
+	}
+	defer in.Close()
+	got, err := ioutil.ReadAll(in)
+	if err != nil || string(got) != "written by an older version" {
+		t.Errorf("Unexpected content %q: %v", got, err)
+	}
+}
+
+// TestScrypt tests the key derivation against the vectors of RFC 7914
+func TestScrypt(t *testing.T) {
+	tests := []struct {
+		password, salt string
+		n, r, p        int
+		expected       string
+	}{
+		{"", "", 16, 1, 1, "77d6576238657b203b19ca42c18a0497f16b4844e3074ae8dfdffa3fede21442fcd0069ded0948f8326a753a0fc81f17e8d3e0fb2e0d3628cf35e20c38d18906"},
+		{"password", "NaCl", 1024, 8, 16, "fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b3731622eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640"},
+	}
+	for _, tt := range tests {
+		key, err := scrypt([]byte(tt.password), []byte(tt.salt), tt.n, tt.r, tt.p, 64)
+		if err != nil {
+			t.Fatalf("scrypt(%q, %q) failed: %v", tt.password, tt.salt, err)
+		}
+		if hex.EncodeToString(key) != tt.expected {
+			t.Errorf("scrypt(%q, %q) = %x, expected %s", tt.password, tt.salt, key, tt.expected)
+		}
+	}
+
+	if got := hex.EncodeToString(pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64)); got != "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783" {
+		t.Errorf("Unexpected PBKDF2-HMAC-SHA256 result %s", got)
+	}
+	if _, err := scrypt([]byte("password"), nil, 1000, 8, 1, 32); err == nil {
+		t.Errorf("scrypt should refuse n that is not a power of 2")
+	}
+}
+
+// TestKeysFile tests that only the password a master key was wrapped with unlocks it
+func TestKeysFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "keys_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, keysFileName)
+
+	cfg := Config{EncryptPassword: "right-password", KeyCost: minKeyCost}
+	if _, err := createKeysFile(path, cfg); err != nil {
+		t.Fatalf("Failed to create keys file: %v", err)
+	}
+	master, _, err := unlockMasterKey(path, []byte("right-password"))
+	if err != nil {
+		t.Fatalf("Failed to unlock master key: %v", err)
+	}
+	if len(master) != masterKeySize || bytes.Equal(master, deriveKey("right-password")) {
+		t.Errorf("Master key should be random, got %x", master)
+	}
+	if _, _, err := unlockMasterKey(path, []byte("wrong-password")); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Expected ErrWrongKey for a wrong password, got %v", err)
+	}
+
+	kf, err := readKeysFile(path)
+	if err != nil || len(kf.Keys) != 1 {
+		t.Fatalf("Unexpected keys file %+v: %v", kf, err)
+	}
+	if w := kf.Keys[0]; w.KDF != kdfScrypt || w.N != 1<<minKeyCost || len(w.Salt) != 32 {
+		t.Errorf("Unexpected wrapped key %+v", w)
+	}
+
+	// the whole key file is the secret, not only its first 32 bytes
+	keyFile := filepath.Join(dir, "secret.key")
+	secret := []byte(strings.Repeat("k", 32) + "tail")
+	if err := ioutil.WriteFile(keyFile, secret, 0600); err != nil {
+		t.Fatalf("Failed to create key file: %v", err)
+	}
+	if _, err := createKeysFile(path, Config{EncryptKeyFile: keyFile, KeyCost: minKeyCost}); err != nil {
+		t.Fatalf("Failed to create keys file: %v", err)
+	}
+	if _, _, err := unlockMasterKey(path, secret[:32]); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("A truncated key file should not unlock the master key, got %v", err)
+	}
+	if _, _, err := unlockMasterKey(path, secret); err != nil {
+		t.Errorf("Failed to unlock master key with key file: %v", err)
+	}
+
+	if _, err := createKeysFile(path, Config{EncryptPassword: "x", KeyCost: maxKeyCost + 1}); err == nil {
+		t.Errorf("Key cost above %d should be refused", maxKeyCost)
+	}
+}
+
 // TestConfigWithEncryption tests config reading/writing with encryption fields
 func TestConfigWithEncryption(t *testing.T) {
 	tempConfigFile := filepath.Join(os.TempDir(), "test_config.json")
@@ -131,7 +333,7 @@ func TestRestoreStateManagement(t *testing.T) {
 	defer os.Remove(tempStateFile)
 	
 	originalState := RestoreState{
-		Version:        1,
+		Version:        "20240506-070809.123456-0a1b2c3d",
 		BackupDir:      "C:\\test\\backup",
 		RestoreDir:     "C:\\test\\restore",
 		StageDir:       "C:\\test\\staging",
@@ -143,20 +345,20 @@ func TestRestoreStateManagement(t *testing.T) {
 	}
 	
 	// Test saving state
-	err := saveRestoreState(tempStateFile, originalState)
+	err := saveRestoreState(tempStateFile, nil, originalState)
 	if err != nil {
 		t.Fatalf("Failed to save restore state: %v", err)
 	}
 	
 	// Test loading state
-	loadedState, err := loadRestoreState(tempStateFile)
+	loadedState, err := loadRestoreState(tempStateFile, nil)
 	if err != nil {
 		t.Fatalf("Failed to load restore state: %v", err)
 	}
 	
 	// Verify critical fields
 	if loadedState.Version != originalState.Version {
-		t.Errorf("Version mismatch: got %d, expected %d", loadedState.Version, originalState.Version)
+		t.Errorf("Version mismatch: got %s, expected %s", loadedState.Version, originalState.Version)
 	}
 	
 	if loadedState.Phase != originalState.Phase {
@@ -365,3 +567,486 @@ func BenchmarkDecryption(b *testing.B) {
 		}
 	}
 }
+
+// TestParseTrimValue tests absolute and relative trim arguments
+func TestParseTrimValue(t *testing.T) {
+	ten := []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10"}
+	named := []string{"2", "20240506-070809.123456-0a1b2c3d", "20240507-070809.123456-0a1b2c3d"}
+	resolve := func(value string) (string, error) {
+		if value == "release" {
+			return named[1], nil
+		}
+		return "", ErrVersionNotFound
+	}
+	cases := []struct {
+		value    string
+		versions []string
+		expected string
+		wantErr  bool
+	}{
+		{"5", ten, "5", false},
+		{"+3", ten, "7", false},
+		{"+30", ten, "0", false},
+		{"0", ten, "0", false},
+		{"+1", []string{"2", "5", "9"}, "5", false},
+		{"+0", nil, "0", false},
+		{"+1", named, named[1], false},
+		{"release", named, named[1], false},
+		{"5", named, "5", false},
+		{"5", named[1:], "", true},
+		{"0", named[1:], "0", false},
+		{"invalid", ten, "", true},
+		{"+", ten, "", true},
+		{"+x", ten, "", true},
+		{"-2", ten, "", true},
+	}
+
+	for _, c := range cases {
+		got, err := parseTrimValue(c.value, c.versions, resolve)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("parseTrimValue(%q) should fail", c.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTrimValue(%q) failed: %v", c.value, err)
+		} else if got != c.expected {
+			t.Errorf("parseTrimValue(%q, %v) = %s, expected %s", c.value, c.versions, got, c.expected)
+		}
+	}
+}
+
+// TestVersionIDs tests naming and ordering of numbered and named versions
+func TestVersionIDs(t *testing.T) {
+	now := time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC)
+	first, err := newVersionID(now, "12")
+	if err != nil {
+		t.Fatalf("newVersionID failed: %v", err)
+	}
+	if !strings.HasPrefix(first, "20240506-070809.123456-") || !validVersionID(first) {
+		t.Errorf("Unexpected version name %q", first)
+	}
+
+	// A clock that went back still names a newer version
+	second, err := newVersionID(now.Add(-time.Hour), first)
+	if err != nil {
+		t.Fatalf("newVersionID failed: %v", err)
+	}
+	if compareVersions(second, first) <= 0 || !strings.HasPrefix(second, "20240506-070809.123457-") {
+		t.Errorf("Version %q should sort after %q", second, first)
+	}
+
+	versions := []string{second, "10", first, "9"}
+	sortVersions(versions)
+	if !reflect.DeepEqual(versions, []string{"9", "10", first, second}) {
+		t.Errorf("Unexpected order %v", versions)
+	}
+
+	for _, id := range []string{"0", "", "-1", "abc", "20240506-070809.123456-xyzxyzxy", first + "0"} {
+		if validVersionID(id) {
+			t.Errorf("%q should not be a valid version", id)
+		}
+	}
+}
+
+// TestRestoreRelativePath tests restore paths for files recorded on Windows and POSIX systems
+func TestRestoreRelativePath(t *testing.T) {
+	cases := []struct {
+		includes []string
+		file     string
+		expected string
+	}{
+		{[]string{`C:\temp`}, `C:\temp\sub\file.txt`, filepath.Join("sub", "file.txt")},
+		{[]string{`c:\TEMP`}, `C:\temp\file.txt`, "file.txt"},
+		{[]string{`C:\temp`, `C:\Users`}, `C:\Users\bob\file.txt`, filepath.Join("Users", "bob", "file.txt")},
+		{[]string{`C:\temp`}, `\\server\share\file.txt`, filepath.Join("server", "share", "file.txt")},
+	}
+	if filepath.Separator == '/' {
+		cases = append(cases,
+			struct {
+				includes []string
+				file     string
+				expected string
+			}{[]string{"/home/user/"}, "/home/user/docs/a.txt", filepath.Join("docs", "a.txt")},
+			struct {
+				includes []string
+				file     string
+				expected string
+			}{[]string{"/home/User"}, "/home/user/a.txt", filepath.Join("home", "user", "a.txt")},
+		)
+	}
+
+	for _, c := range cases {
+		got := restoreRelativePath(c.includes, c.file)
+		if got != c.expected {
+			t.Errorf("restoreRelativePath(%v, %q) = %q, expected %q", c.includes, c.file, got, c.expected)
+		}
+	}
+}
+
+// TestIsExcluded tests exclusion of files and folders below excluded paths
+func TestIsExcluded(t *testing.T) {
+	base := filepath.Join(os.TempDir(), "exclude_test")
+	excludes := []string{comparePath(filepath.Join(base, "skip")), comparePath(filepath.Join(base, "file.txt"))}
+
+	if !isExcluded(filepath.Join(base, "skip"), excludes) {
+		t.Errorf("Excluded folder should be excluded")
+	}
+	if !isExcluded(filepath.Join(base, "skip", "inner.txt"), excludes) {
+		t.Errorf("File below excluded folder should be excluded")
+	}
+	if !isExcluded(filepath.Join(base, "file.txt"), excludes) {
+		t.Errorf("Excluded file should be excluded")
+	}
+	if isExcluded(filepath.Join(base, "skipped.txt"), excludes) {
+		t.Errorf("File sharing a prefix with an excluded folder should not be excluded")
+	}
+}
+
+// writeTestManifest writes entries to a version file in memory
+func writeTestManifest(t *testing.T, entries []ManifestEntry) []byte {
+	var buf bytes.Buffer
+	mw, err := NewManifestWriter(&buf, ManifestHeader{Version: "3", Date: time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC)})
+	if err != nil {
+		t.Fatalf("NewManifestWriter failed: %v", err)
+	}
+	for _, e := range entries {
+		if err := mw.Write(e); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// readTestManifest reads all entries of a version file in memory
+func readTestManifest(data []byte) (ManifestHeader, []ManifestEntry, error) {
+	mr, err := NewManifestReader(bytes.NewReader(data))
+	if err != nil {
+		return ManifestHeader{}, nil, err
+	}
+	var entries []ManifestEntry
+	for {
+		e, err := mr.Next()
+		if err == io.EOF {
+			return mr.Header(), entries, nil
+		}
+		if err != nil {
+			return mr.Header(), entries, err
+		}
+		entries = append(entries, e)
+	}
+}
+
+// TestManifestRoundTrip tests that entries keep exact sizes, times and unusual paths
+func TestManifestRoundTrip(t *testing.T) {
+	entries := []ManifestEntry{
+		{Path: "/data/plain.txt", ModTime: time.Date(2024, 1, 2, 3, 4, 5, 987654321, time.UTC), Size: 1, Hash: "001002"},
+		{Path: "/data/line\r\nbreak%41.txt", ModTime: time.Unix(1700000000, 5), Size: 1<<40 + 3, Hash: "004005", Changed: true},
+		{Path: "/data/FILE:trick\nHASH:000", ModTime: time.Unix(0, 0), Size: 0, Hash: "006007"},
+	}
+
+	header, got, err := readTestManifest(writeTestManifest(t, entries))
+	if err != nil {
+		t.Fatalf("Reading manifest failed: %v", err)
+	}
+	if header.Format != ManifestFormat || header.Version != "3" || header.Date.Nanosecond() != 123456789 {
+		t.Errorf("Unexpected header %+v", header)
+	}
+	if len(got) != len(entries) {
+		t.Fatalf("Expected %d entries, got %d", len(entries), len(got))
+	}
+	for i := range entries {
+		if got[i].Path != entries[i].Path || got[i].Size != entries[i].Size ||
+			got[i].Hash != entries[i].Hash || !got[i].ModTime.Equal(entries[i].ModTime) ||
+			got[i].Changed != entries[i].Changed {
+			t.Errorf("Entry %d = %+v, expected %+v", i, got[i], entries[i])
+		}
+	}
+}
+
+// TestManifestRoots tests that the folder trees of a version survive a round trip
+func TestManifestRoots(t *testing.T) {
+	roots := []ManifestRoot{{Path: "C:\\data", Tree: "0a0b"}, {Path: "/home/%user\r\n", Tree: "0c0d"}}
+
+	var buf bytes.Buffer
+	mw, err := NewManifestWriter(&buf, ManifestHeader{Version: "1", Date: time.Unix(1, 0), Roots: roots})
+	if err != nil {
+		t.Fatalf("Writing manifest failed: %v", err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("Closing manifest failed: %v", err)
+	}
+
+	header, entries, err := readTestManifest(buf.Bytes())
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("Reading manifest failed: %v", err)
+	}
+	if !reflect.DeepEqual(header.Roots, roots) {
+		t.Errorf("Expected roots %v, got %v", roots, header.Roots)
+	}
+
+	broken := bytes.Replace(buf.Bytes(), []byte("TREE:0c0d\r\n"), nil, 1)
+	if _, _, err := readTestManifest(broken); !errors.Is(err, ErrCorruptManifest) {
+		t.Errorf("A root without its tree should be corrupt, got %v", err)
+	}
+}
+
+// TestManifestTruncated tests that cut off or altered version files are detected
+func TestManifestTruncated(t *testing.T) {
+	data := writeTestManifest(t, []ManifestEntry{
+		{Path: "/a", ModTime: time.Unix(1, 0), Size: 10, Hash: "001002"},
+		{Path: "/b", ModTime: time.Unix(2, 0), Size: 20, Hash: "003004"},
+	})
+
+	// cut at every line ending, the file must never read as complete
+	for i := 0; i < len(data)-1; i++ {
+		if data[i] != '\n' {
+			continue
+		}
+		if _, _, err := readTestManifest(data[:i+1]); !errors.Is(err, ErrCorruptManifest) {
+			t.Errorf("Manifest cut after %d bytes should be corrupt, got %v", i+1, err)
+		}
+	}
+
+	altered := bytes.Replace(data, []byte("SIZE:20"), []byte("SIZE:21"), 1)
+	if _, _, err := readTestManifest(altered); !errors.Is(err, ErrCorruptManifest) {
+		t.Errorf("Altered manifest should be corrupt, got %v", err)
+	}
+}
+
+// TestManifestFormat1 tests reading version files written before the format header
+func TestManifestFormat1(t *testing.T) {
+	data := "VERSION:4\r\nDATE:01/02/2020 10:11:12 +0000\r\n" +
+		"FILE:C:\\temp\\a.txt\r\nMODDATE:01/02/2020 09:00:00 +0000\r\nSIZE:0.500000\r\nHASH:001002\r\n" +
+		"FILE:C:\\temp\\b%.txt\r\nMODDATE:01/02/2020 09:30:00 +0000\r\nSIZE:2.000000\r\nHASH:003004\r\n"
+
+	header, entries, err := readTestManifest([]byte(data))
+	if err != nil {
+		t.Fatalf("Reading format 1 manifest failed: %v", err)
+	}
+	if header.Format != 1 || header.Version != "4" {
+		t.Errorf("Unexpected header %+v", header)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(entries))
+	}
+	if entries[0].Size != 512*1024 || entries[1].Size != 2*1024*1024 {
+		t.Errorf("Sizes should be converted from megabytes, got %d and %d", entries[0].Size, entries[1].Size)
+	}
+	if entries[1].Path != `C:\temp\b%.txt` || entries[1].Hash != "003004" {
+		t.Errorf("Unexpected entry %+v", entries[1])
+	}
+}
+
+// TestWriteFileAtomic tests that a failed write leaves neither the file nor a temp file behind
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := os.MkdirTemp("", "atomic_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "blob")
+	err = writeFileAtomic(target, func(w io.Writer) error {
+		w.Write([]byte("partial"))
+		return errors.New("interrupted")
+	})
+	if err == nil {
+		t.Fatalf("writeFileAtomic should return the write error")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Failed write should leave no files, found %d", len(entries))
+	}
+
+	err = writeFileAtomic(target, func(w io.Writer) error {
+		_, err := w.Write([]byte("complete"))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("writeFileAtomic failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(target)
+	if err != nil || string(data) != "complete" {
+		t.Errorf("Expected complete file, got %q (%v)", data, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Successful write should leave only the file, found %d entries", len(entries))
+	}
+}
+
+// TestStoreFile tests that a file is stored under the hash of its content in a single pass
+func TestStoreFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "store_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source.txt")
+	content := []byte(strings.Repeat("stored once ", 1000))
+	if err := ioutil.WriteFile(source, content, 0644); err != nil {
+		t.Fatalf("Failed to create source file: %v", err)
+	}
+
+	r, err := Init(Config{BackupDir: filepath.Join(dir, "backup"), EncryptPassword: "secret"})
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+
+	entry, stored, err := r.storeFile(source)
+	if err != nil {
+		t.Fatalf("storeFile failed: %v", err)
+	}
+	if stored != 1 || entry.Changed || entry.Size != int64(len(content)) {
+		t.Errorf("Unexpected first store: stored=%v entry=%+v", stored, entry)
+	}
+
+	expected, _ := r.hashFile(source)
+	plain := sha256.Sum256(content)
+	if entry.Hash != expected || len(entry.Hash) != 64 || entry.Hash == hex.EncodeToString(plain[:]) {
+		t.Errorf("Blob should be named by the hex keyed sha256 of the file, got %s", entry.Hash)
+	}
+	actual, err := r.hashBlob(entry.Hash)
+	if err != nil || r.hashName(actual) != entry.Hash {
+		t.Errorf("Stored blob does not match its name (%v)", err)
+	}
+
+	if _, stored, err := r.storeFile(source); err != nil || stored != 0 {
+		t.Errorf("Second store should reuse the blob: stored=%v err=%v", stored, err)
+	}
+
+	leftovers, _ := filepath.Glob(filepath.Join(r.filesDir, "*"+tempFileSuffix))
+	if len(leftovers) != 0 {
+		t.Errorf("Temp blobs should not be left behind: %v", leftovers)
+	}
+}
+
+// TestKeyedBlobNames tests that encrypted repositories name stored files with
+// their own key while unencrypted ones use the plain sha256
+func TestKeyedBlobNames(t *testing.T) {
+	dir, err := os.MkdirTemp("", "blobname_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte("leaked document")
+	plain := sha256.Sum256(data)
+
+	first := Config{BackupDir: filepath.Join(dir, "first"), EncryptPassword: "secret", KeyCost: minKeyCost}
+	second := Config{BackupDir: filepath.Join(dir, "second"), EncryptPassword: "secret", KeyCost: minKeyCost}
+	var names []string
+	for _, cfg := range []Config{first, second, {BackupDir: filepath.Join(dir, "plain")}} {
+		if _, err := Init(cfg); err != nil {
+			t.Fatalf("Init failed: %v", err)
+		}
+		r, err := Open(cfg)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		names = append(names, r.hashData(data))
+	}
+
+	if names[0] == hex.EncodeToString(plain[:]) || names[0] == names[1] {
+		t.Errorf("Encrypted repositories should name files with their own key: %v", names)
+	}
+	if names[2] != hex.EncodeToString(plain[:]) {
+		t.Errorf("Unencrypted repositories should name files by their sha256, got %s", names[2])
+	}
+
+	// the name stays the same for every password unlocking the repository
+	other := first
+	other.EncryptPassword = "other"
+	if _, err := AddKey(first, "", other); err != nil {
+		t.Fatalf("AddKey failed: %v", err)
+	}
+	r, err := Open(other)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if name := r.hashData(data); name != names[0] {
+		t.Errorf("Names should not depend on the password, got %s and %s", name, names[0])
+	}
+}
+
+// TestShardDepth tests that stored files are nested in the configured number of hash folders
+func TestShardDepth(t *testing.T) {
+	dir, err := os.MkdirTemp("", "shard_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := Init(Config{BackupDir: filepath.Join(dir, "bad"), ShardDepth: maxShardDepth + 1}); err == nil {
+		t.Errorf("Init should reject a shard depth above %d", maxShardDepth)
+	}
+
+	r, err := Init(Config{BackupDir: filepath.Join(dir, "backup"), ShardDepth: 2})
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(r.filesDir, "ff")); err != nil {
+		t.Errorf("Init should create the first level of hash folders: %v", err)
+	}
+
+	// random data does not compress below the pack limit so it is stored loose
+	data := make([]byte, packBlobLimit*2)
+	x := uint32(11)
+	for i := range data {
+		x = x*1664525 + 1013904223
+		data[i] = byte(x >> 24)
+	}
+	hash, stored, err := r.storeBlob(data)
+	if err != nil || !stored {
+		t.Fatalf("storeBlob failed: stored=%v err=%v", stored, err)
+	}
+
+	expected := filepath.Join(r.filesDir, hash[:2], hash[2:4], hash)
+	if r.blobFile(hash) != expected {
+		t.Errorf("Expected blob path %s, got %s", expected, r.blobFile(hash))
+	}
+	if _, err := os.Stat(expected); err != nil {
+		t.Errorf("Blob should be stored two folders deep: %v", err)
+	}
+}
+
+// TestChunker tests chunk sizes and that the chunks add up to the input
+func TestChunker(t *testing.T) {
+	data := make([]byte, 512*1024)
+	x := uint32(7)
+	for i := range data {
+		x = x*1664525 + 1013904223
+		data[i] = byte(x >> 24)
+	}
+
+	c := newChunker(bytes.NewReader(data), 8*1024)
+	var joined []byte
+	var sizes []int
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		joined = append(joined, chunk...)
+		sizes = append(sizes, len(chunk))
+	}
+
+	if !bytes.Equal(joined, data) {
+		t.Fatalf("Chunks do not add up to the input")
+	}
+	for i, size := range sizes {
+		if size > 32*1024 || (size < 2*1024 && i != len(sizes)-1) {
+			t.Errorf("Chunk %d has size %d outside the limits", i, size)
+		}
+	}
+	if len(sizes) < 16 || len(sizes) > 256 {
+		t.Errorf("Expected about 64 chunks, got %d", len(sizes))
+	}
+}
@@ -0,0 +1,352 @@
+package gitstylebackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// treeMagic starts every stored tree so it never reads as anything else
+const treeMagic = "GITSTYLEBACKUP TREE 1\n"
+
+// Types of the entries in a tree
+const (
+	treeEntryFile = "file"
+	treeEntryDir  = "dir"
+)
+
+// treeEntry is one file or folder in a stored tree. Like a git tree, a folder
+// refers to the tree of its content by hash, so a folder that did not change
+// between versions is stored once and shared by all of them.
+type treeEntry struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Hash    string   `json:"hash"` // content hash of a file, tree hash of a folder
+	ModTime int64    `json:"mtime,omitempty"`
+	Size    int64    `json:"size,omitempty"`
+	Chunks  []string `json:"chunks,omitempty"`
+	Changed bool     `json:"changed,omitempty"`
+	Inode   uint64   `json:"inode,omitempty"`
+	CTime   int64    `json:"ctime,omitempty"`
+}
+
+// tree is the stored form of one folder, its entries are sorted by name
+type tree struct {
+	Entries []treeEntry `json:"entries"`
+}
+
+// unixNano returns t in nanoseconds, 0 for the zero time
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNano reverses unixNano
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// treeNode is a folder of a new version while its trees are built
+type treeNode struct {
+	modTime time.Time
+	files   map[string]ManifestEntry
+	dirs    map[string]*treeNode
+}
+
+func newTreeNode() *treeNode {
+	return &treeNode{files: map[string]ManifestEntry{}, dirs: map[string]*treeNode{}}
+}
+
+// node returns the folder at the path elements below n, creating it
+func (n *treeNode) node(parts []string) *treeNode {
+	for _, part := range parts {
+		child, ok := n.dirs[part]
+		if !ok {
+			child = newTreeNode()
+			n.dirs[part] = child
+		}
+		n = child
+	}
+	return n
+}
+
+// relativeParts splits path into its elements below root, ok is false when
+// path is not root or below it
+func relativeParts(root, path string) ([]string, bool) {
+	if path == root {
+		return nil, true
+	}
+	prefix := root
+	if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+		prefix += string(filepath.Separator)
+	}
+	if !strings.HasPrefix(path, prefix) {
+		return nil, false
+	}
+	return strings.Split(path[len(prefix):], string(filepath.Separator)), true
+}
+
+// buildTree returns the folder an include path is stored under and the
+// folders and files found below it, nil when the walk found nothing there.
+// An include path that is a single file is stored as a tree of its folder
+// holding only that file.
+func buildTree(include string, dirs []walkedFile, entries []ManifestEntry) (string, *treeNode) {
+	root := filepath.Clean(include)
+	if info, err := os.Lstat(root); err == nil && !info.IsDir() {
+		for _, e := range entries {
+			if e.Path == root {
+				top := newTreeNode()
+				top.files[filepath.Base(root)] = e
+				return filepath.Dir(root), top
+			}
+		}
+		return filepath.Dir(root), nil
+	}
+
+	var top *treeNode
+	for _, dir := range dirs {
+		parts, ok := relativeParts(root, dir.path)
+		if !ok {
+			continue
+		}
+		if top == nil {
+			top = newTreeNode()
+		}
+		top.node(parts).modTime = dir.info.ModTime()
+	}
+	for _, e := range entries {
+		parts, ok := relativeParts(root, e.Path)
+		if !ok || len(parts) == 0 {
+			continue
+		}
+		if top == nil {
+			top = newTreeNode()
+		}
+		top.node(parts[:len(parts)-1]).files[parts[len(parts)-1]] = e
+	}
+	return root, top
+}
+
+// storeTree stores the trees of a folder and everything below it. It returns
+// the hash of its tree and the number of trees that were new.
+func (r *Repository) storeTree(n *treeNode) (string, int, error) {
+	var t tree
+	var newTrees int
+	for name, child := range n.dirs {
+		hash, stored, err := r.storeTree(child)
+		if err != nil {
+			return "", 0, err
+		}
+		newTrees += stored
+		t.Entries = append(t.Entries, treeEntry{
+			Name:    name,
+			Type:    treeEntryDir,
+			Hash:    hash,
+			ModTime: unixNano(child.modTime),
+		})
+	}
+	for name, e := range n.files {
+		t.Entries = append(t.Entries, treeEntry{
+			Name:    name,
+			Type:    treeEntryFile,
+			Hash:    e.Hash,
+			ModTime: unixNano(e.ModTime),
+			Size:    e.Size,
+			Chunks:  e.Chunks,
+			Changed: e.Changed,
+			Inode:   e.Inode,
+			CTime:   unixNano(e.ChangeTime),
+		})
+	}
+	sort.Slice(t.Entries, func(i, j int) bool { return t.Entries[i].Name < t.Entries[j].Name })
+
+	data, err := json.Marshal(t)
+	if err != nil {
+		return "", 0, err
+	}
+	hash, stored, err := r.storeBlob(append([]byte(treeMagic), data...))
+	if stored {
+		newTrees++
+	}
+	return hash, newTrees, err
+}
+
+// readTree reads a stored tree and checks it against its hash. Errors wrap
+// ErrBlobMissing or ErrBlobCorrupt.
+func (r *Repository) readTree(hash string) ([]treeEntry, error) {
+	raw, err := r.openBlob(hash)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrBlobMissing
+		}
+		return nil, err
+	}
+	in, err := newStoredFileReader(raw, r.key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBlobCorrupt, err)
+	}
+	data, err := ioutil.ReadAll(in)
+	in.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBlobCorrupt, err)
+	}
+
+	if r.hashData(data) != hash || !bytes.HasPrefix(data, []byte(treeMagic)) {
+		return nil, fmt.Errorf("%w: not the tree %s", ErrBlobCorrupt, hash)
+	}
+	var t tree
+	if err := json.Unmarshal(data[len(treeMagic):], &t); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBlobCorrupt, err)
+	}
+	return t.Entries, nil
+}
+
+// recordedSeparator returns the separator of the paths below a root, which
+// follows the system the version was written on
+func recordedSeparator(root string) string {
+	if isWindowsPath(root) {
+		return `\`
+	}
+	if strings.HasPrefix(root, "/") {
+		return "/"
+	}
+	return string(filepath.Separator)
+}
+
+// joinRecordedPath adds a name to a folder path recorded in a version
+func joinRecordedPath(dir, name, sep string) string {
+	if strings.HasSuffix(dir, sep) {
+		return dir + name
+	}
+	return dir + sep + name
+}
+
+// manifestEntry returns the version entry of a file in a tree
+func (e treeEntry) manifestEntry(path string) ManifestEntry {
+	return ManifestEntry{
+		Path:       path,
+		ModTime:    fromUnixNano(e.ModTime),
+		Size:       e.Size,
+		Hash:       e.Hash,
+		Chunks:     e.Chunks,
+		Changed:    e.Changed,
+		Inode:      e.Inode,
+		ChangeTime: fromUnixNano(e.CTime),
+	}
+}
+
+// treeWalker calls fn for the files below stored trees. A tree that cannot
+// be read is passed to treeErr, which may return nil to skip it. Without
+// treeErr the walk stops at the first such tree.
+type treeWalker struct {
+	r       *Repository
+	fn      func(ManifestEntry) error
+	treeErr func(*BlobError) error
+}
+
+// walk calls fn for every file below the tree of the folder dir
+func (w *treeWalker) walk(dir, hash, sep string) error {
+	entries, err := w.r.readTree(hash)
+	if err != nil {
+		blobErr := &BlobError{Hash: hash, Path: dir, Err: err}
+		if w.treeErr == nil {
+			return blobErr
+		}
+		return w.treeErr(blobErr)
+	}
+
+	for _, e := range entries {
+		path := joinRecordedPath(dir, e.Name, sep)
+		if e.Type == treeEntryDir {
+			err = w.walk(path, e.Hash, sep)
+		} else {
+			err = w.fn(e.manifestEntry(path))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readVersion reads a version and calls fn for every file in it, whether the
+// version lists its files itself or refers to trees. treeErr handles trees
+// that cannot be read as described for treeWalker.
+func (r *Repository) readVersion(version string, fn func(ManifestEntry) error, treeErr func(*BlobError) error) (ManifestHeader, error) {
+	header, err := readManifestFile(r.versionFile(version), r.key, fn)
+	if err != nil {
+		return header, err
+	}
+
+	w := &treeWalker{r: r, fn: fn, treeErr: treeErr}
+	for _, root := range header.Roots {
+		if err := w.walk(root.Path, root.Tree, recordedSeparator(root.Path)); err != nil {
+			return header, err
+		}
+	}
+	return header, nil
+}
+
+// versionBlobs calls fn for every stored file a version needs, its trees
+// included. Trees already in seen are skipped with everything below them,
+// so reading versions that share folders reads each folder once.
+func (r *Repository) versionBlobs(version string, seen map[string]bool, fn func(hash string)) error {
+	header, err := readManifestFile(r.versionFile(version), r.key, func(e ManifestEntry) error {
+		for _, hash := range e.Blobs() {
+			fn(hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, root := range header.Roots {
+		if err := r.treeBlobs(root.Path, root.Tree, seen, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// treeBlobs calls fn for a tree and every stored file below it
+func (r *Repository) treeBlobs(dir, hash string, seen map[string]bool, fn func(hash string)) error {
+	if seen[hash] {
+		return nil
+	}
+	entries, err := r.readTree(hash)
+	if err != nil {
+		return &BlobError{Hash: hash, Path: dir, Err: err}
+	}
+	seen[hash] = true
+	fn(hash)
+
+	sep := recordedSeparator(dir)
+	for _, e := range entries {
+		if e.Type == treeEntryDir {
+			if err := r.treeBlobs(joinRecordedPath(dir, e.Name, sep), e.Hash, seen, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(e.Chunks) > 0 {
+			for _, chunk := range e.Chunks {
+				fn(chunk)
+			}
+		} else {
+			fn(e.Hash)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package gitstylebackup
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// New versions are named by the UTC time the backup started, to the
+// microsecond, and a random suffix, e.g. 20261016-153045.123456-9f3a1c0b.
+// Names sort by time, two backups starting together or repositories merged
+// later never get the same name, and no counter has to be read first.
+// Versions written before are named by a number, they stay readable and sort
+// before every named version.
+const (
+	versionIDTime   = "20060102-150405.000000"
+	versionIDRandom = 4 // random bytes after the time
+	versionIDLen    = len(versionIDTime) + 1 + 2*versionIDRandom
+
+	// latestVersionName names the newest version of a source, "latest~n"
+	// the one n versions before it
+	latestVersionName = "latest"
+
+	// minVersionPrefix is the shortest prefix accepted for a version name
+	minVersionPrefix = 4
+)
+
+// dateSelectorFormats are the dates a version can be selected by, a date
+// selects the newest version made at or before it
+var dateSelectorFormats = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// newVersionID returns a name for a version started at now, sorting after
+// latest, the newest version in the repository, even when the clock went back
+func newVersionID(now time.Time, latest string) (string, error) {
+	t := now.UTC().Truncate(time.Microsecond)
+	if lt, ok := versionIDTimeOf(latest); ok && !t.After(lt) {
+		t = lt.Add(time.Microsecond)
+	}
+
+	suffix := make([]byte, versionIDRandom)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("error naming version: %v", err)
+	}
+	return t.Format(versionIDTime) + "-" + hex.EncodeToString(suffix), nil
+}
+
+// versionIDTimeOf returns the time in a version name, ok is false for
+// numbered versions
+func versionIDTimeOf(id string) (time.Time, bool) {
+	if len(id) != versionIDLen || id[len(versionIDTime)] != '-' {
+		return time.Time{}, false
+	}
+	if _, err := hex.DecodeString(id[len(versionIDTime)+1:]); err != nil {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(versionIDTime, id[:len(versionIDTime)])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// numberedVersion returns the number of a version written before versions
+// were named, ok is false for named versions
+func numberedVersion(id string) (int, bool) {
+	if id == "" || strings.IndexFunc(id, func(c rune) bool { return c < '0' || c > '9' }) >= 0 {
+		return 0, false
+	}
+	num, err := strconv.Atoi(id)
+	return num, err == nil
+}
+
+// hasNumberedVersion reports whether any of versions was written before
+// versions were named
+func hasNumberedVersion(versions []string) bool {
+	for _, version := range versions {
+		if _, ok := numberedVersion(version); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validVersionID reports whether id is the name of a numbered or named version
+func validVersionID(id string) bool {
+	if num, ok := numberedVersion(id); ok {
+		return num > 0
+	}
+	_, ok := versionIDTimeOf(id)
+	return ok
+}
+
+// compareVersions orders versions from oldest to newest, numbered versions
+// by number and before all named versions
+func compareVersions(a, b string) int {
+	an, aNumbered := numberedVersion(a)
+	bn, bNumbered := numberedVersion(b)
+	switch {
+	case aNumbered && bNumbered:
+		return an - bn
+	case aNumbered:
+		return -1
+	case bNumbered:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// sortVersions sorts versions from oldest to newest
+func sortVersions(versions []string) {
+	sort.Slice(versions, func(i, j int) bool { return compareVersions(versions[i], versions[j]) < 0 })
+}
+
+// resolveVersion returns the version named by value. Accepted are
+//
+//	0, latest      the newest version of this repository's source
+//	latest~n       the version n before it
+//	a number       a numbered version
+//	a name         a named version, or a unique prefix of at least 4 characters
+//	a tag          the version with the tag
+//	a date         the newest version of this source made at or before it
+func (r *Repository) resolveVersion(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || strings.HasPrefix(value, "-") {
+		return "", fmt.Errorf("invalid version %q", value)
+	}
+
+	if value == "0" || value == latestVersionName || strings.HasPrefix(value, latestVersionName+"~") {
+		back := 0
+		if n := strings.TrimPrefix(value, latestVersionName+"~"); n != value {
+			var err error
+			if back, err = strconv.Atoi(n); err != nil || back < 0 {
+				return "", fmt.Errorf("invalid version %q", value)
+			}
+		}
+		versions, err := r.sourceVersions()
+		if err != nil {
+			return "", err
+		}
+		if len(versions) == 0 {
+			return "", fmt.Errorf("%w: no versions of %s found", ErrVersionNotFound, r.source())
+		}
+		if back >= len(versions) {
+			return "", fmt.Errorf("%w: %s has %d versions, no %s", ErrVersionNotFound, r.source(), len(versions), value)
+		}
+		return versions[len(versions)-1-back], nil
+	}
+
+	if validVersionID(value) {
+		if _, err := os.Stat(r.versionFile(value)); err == nil {
+			return value, nil
+		}
+	}
+
+	tagged, found, err := r.findTag(value)
+	if err != nil {
+		return "", err
+	}
+	if found {
+		return tagged, nil
+	}
+
+	if at, ok := parseDateSelector(value); ok {
+		return r.versionAt(value, at)
+	}
+
+	if len(value) >= minVersionPrefix {
+		return r.versionWithPrefix(value)
+	}
+	return "", fmt.Errorf("%w: no version or tag %q", ErrVersionNotFound, value)
+}
+
+// parseDateSelector parses a date given to select a version. A date without
+// a time selects the end of that day.
+func parseDateSelector(value string) (time.Time, bool) {
+	for _, layout := range dateSelectorFormats {
+		t, err := time.ParseInLocation(layout, value, time.Local)
+		if err != nil {
+			continue
+		}
+		if layout == "2006-01-02" {
+			t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// versionAt returns the newest version of this repository's source made at
+// or before at
+func (r *Repository) versionAt(value string, at time.Time) (string, error) {
+	headers, err := r.ListVersions()
+	if err != nil {
+		return "", err
+	}
+	for i := len(headers) - 1; i >= 0; i-- {
+		if !headers[i].Date.After(at) {
+			return headers[i].Version, nil
+		}
+	}
+	return "", fmt.Errorf("%w: no version of %s made before %s", ErrVersionNotFound, r.source(), value)
+}
+
+// versionWithPrefix returns the version whose name starts with prefix
+func (r *Repository) versionWithPrefix(prefix string) (string, error) {
+	versions, err := r.Versions()
+	if err != nil {
+		return "", err
+	}
+
+	var found []string
+	for _, ver := range versions {
+		if _, numbered := numberedVersion(ver); !numbered && strings.HasPrefix(ver, prefix) {
+			found = append(found, ver)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("%w: no version or tag %q", ErrVersionNotFound, prefix)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("%w: %q could be any of %s", ErrVersionNotFound, prefix, strings.Join(found, ", "))
+}
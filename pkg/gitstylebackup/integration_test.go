@@ -1,11 +1,18 @@
 package gitstylebackup
 
 import (
+	"bytes"
+	"errors"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 // TestFullBackupRestoreWorkflow tests the complete backup and restore process
@@ -60,8 +67,8 @@ func TestFullBackupRestoreWorkflow(t *testing.T) {
 	}
 	
 	// Verify backup structure was created
-	versionDir := filepath.Join(backupDir, "version")
-	filesDir := filepath.Join(backupDir, "files")
+	versionDir := filepath.Join(backupDir, "Version")
+	filesDir := filepath.Join(backupDir, "Files")
 	
 	exists, err := FolderExists(versionDir)
 	if err != nil || !exists {
@@ -74,7 +81,7 @@ func TestFullBackupRestoreWorkflow(t *testing.T) {
 	}
 	
 	// Test restore
-	err = Restore(config, "1", restoreDir)
+	err = Restore(config, "latest", restoreDir)
 	if err != nil {
 		t.Fatalf("Restore failed: %v", err)
 	}
@@ -156,7 +163,7 @@ func TestEncryptedBackupRestoreWorkflow(t *testing.T) {
 	}
 	
 	// Test encrypted restore
-	err = Restore(config, "1", restoreDir)
+	err = Restore(config, "latest", restoreDir)
 	if err != nil {
 		t.Fatalf("Encrypted restore failed: %v", err)
 	}
@@ -216,7 +223,7 @@ func TestStagingRestoreWorkflow(t *testing.T) {
 	}
 	
 	// Test restore with staging
-	err = Restore(config, "1", restoreDir)
+	err = Restore(config, "latest", restoreDir)
 	if err != nil {
 		t.Fatalf("Staging restore failed: %v", err)
 	}
@@ -293,7 +300,7 @@ func TestMultipleVersionsWorkflow(t *testing.T) {
 	
 	// Test restoring each version
 	for i, expectedContent := range versions {
-		versionNum := strconv.Itoa(i + 1)
+		versionNum := nthVersion(t, config, i+1)
 		
 		// Clean restore directory
 		os.RemoveAll(restoreDir)
@@ -332,8 +339,8 @@ func TestErrorHandling(t *testing.T) {
 	}
 	
 	err := Restore(config, "999", filepath.Join(tempDir, "restore"))
-	if err == nil {
-		t.Errorf("Restore should fail with non-existent backup version")
+	if !errors.Is(err, ErrNotRepository) {
+		t.Errorf("Restore from a missing backup directory should return ErrNotRepository: %v", err)
 	}
 	
 	// Test with invalid encryption key file
@@ -343,3 +350,1716 @@ func TestErrorHandling(t *testing.T) {
 		t.Errorf("Should fail with non-existent key file")
 	}
 }
+
+// TestTrimWorkflow tests that trim removes old versions and the files only they reference
+func TestTrimWorkflow(t *testing.T) {
+	tempDir := filepath.Join(os.TempDir(), "gitstyle_trim_integration_test")
+	backupDir := filepath.Join(tempDir, "backup")
+	versionDir := filepath.Join(backupDir, "Version")
+	filesDir := filepath.Join(backupDir, "Files")
+
+	// Clean up after test
+	os.RemoveAll(tempDir)
+	defer os.RemoveAll(tempDir)
+
+	if _, err := Init(Config{BackupDir: backupDir}); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+
+	// Version 1 references a file only it uses, all versions share a common file
+	versions := map[string][]string{
+		"1": {"111old", "222shared"},
+		"2": {"222shared"},
+		"3": {"222shared", "333new"},
+	}
+	for ver, hashes := range versions {
+		content := "VERSION:" + ver + "\r\n"
+		for _, hash := range hashes {
+			content += "FILE:file_" + hash + "\r\nHASH:" + hash + "\r\n"
+			blobDir := filepath.Join(filesDir, hash[:2])
+			if err := os.MkdirAll(blobDir, 0755); err != nil {
+				t.Fatalf("Failed to create blob directory: %v", err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(blobDir, hash), []byte("blob "+hash), 0644); err != nil {
+				t.Fatalf("Failed to create blob: %v", err)
+			}
+		}
+		if err := os.MkdirAll(versionDir, 0755); err != nil {
+			t.Fatalf("Failed to create version directory: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(versionDir, ver), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create version file: %v", err)
+		}
+	}
+
+	config := Config{BackupDir: backupDir}
+
+	result, err := Trim(config, "+1")
+	if err != nil {
+		t.Fatalf("Trim failed: %v", err)
+	}
+
+	if result.TrimVersion != "2" {
+		t.Errorf("Expected trim to version 2, got %s", result.TrimVersion)
+	}
+	if result.VersionsRemoved != 1 {
+		t.Errorf("Expected 1 version removed, got %d", result.VersionsRemoved)
+	}
+	if result.BlobsRemoved != 1 {
+		t.Errorf("Expected 1 blob removed, got %d", result.BlobsRemoved)
+	}
+	if result.BytesReclaimed <= 0 {
+		t.Errorf("Expected reclaimed bytes to be positive, got %d", result.BytesReclaimed)
+	}
+
+	if exists, _ := FileExists(filepath.Join(versionDir, "1")); exists {
+		t.Errorf("Version 1 should have been removed")
+	}
+	if exists, _ := FileExists(filepath.Join(filesDir, "11", "111old")); exists {
+		t.Errorf("Blob only referenced by version 1 should have been removed")
+	}
+	if exists, _ := FileExists(filepath.Join(filesDir, "22", "222shared")); !exists {
+		t.Errorf("Shared blob should have been kept")
+	}
+	if exists, _ := FileExists(filepath.Join(backupDir, "InUse.txt")); exists {
+		t.Errorf("In-use file should be removed after trim")
+	}
+}
+
+// TestVerifyWorkflow tests that verify reports missing and corrupted files
+func TestVerifyWorkflow(t *testing.T) {
+	tempDir := filepath.Join(os.TempDir(), "gitstyle_verify_integration_test")
+	sourceDir := filepath.Join(tempDir, "source")
+	backupDir := filepath.Join(tempDir, "backup")
+	versionDir := filepath.Join(backupDir, "Version")
+	filesDir := filepath.Join(backupDir, "Files")
+
+	// Clean up after test
+	os.RemoveAll(tempDir)
+	defer os.RemoveAll(tempDir)
+
+	repo, err := Init(Config{BackupDir: backupDir})
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+
+	for _, dir := range []string{sourceDir, versionDir, filesDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Failed to create directory %s: %v", dir, err)
+		}
+	}
+
+	// storeFile writes a source file and stores it the way backup does
+	storeFile := func(name, content string) string {
+		path := filepath.Join(sourceDir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create source file: %v", err)
+		}
+		sHash, err := repo.hashFile(path)
+		if err != nil {
+			t.Fatalf("Failed to hash file: %v", err)
+		}
+		os.MkdirAll(filepath.Dir(repo.blobFile(sHash)), 0755)
+		if err := CopyFileAndGZip(path, repo.blobFile(sHash)); err != nil {
+			t.Fatalf("Failed to store file: %v", err)
+		}
+		return sHash
+	}
+
+	goodHash := storeFile("good.txt", "good content")
+	writeVersion := func(ver string, lines string) {
+		err := ioutil.WriteFile(filepath.Join(versionDir, ver), []byte("VERSION:"+ver+"\r\n"+lines), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write version file: %v", err)
+		}
+	}
+	writeVersion("1", "FILE:good.txt\r\nHASH:"+goodHash+"\r\n")
+
+	config := Config{BackupDir: backupDir}
+
+	report, err := Verify(config, "0")
+	if err != nil {
+		t.Fatalf("Verify of a good version failed: %v", err)
+	}
+	if report.Version != "1" || report.FilesChecked != 1 || !report.OK() {
+		t.Errorf("Unexpected report for good version: %+v", report)
+	}
+
+	// Version 2 has a missing file and a file whose content does not match its name
+	badHash := storeFile("bad.txt", "original content")
+	corruptHash := storeFile("corrupt.txt", "replaced content")
+	os.Rename(filepath.Join(filesDir, corruptHash[:2], corruptHash), filepath.Join(filesDir, badHash[:2], badHash))
+	writeVersion("2", "FILE:good.txt\r\nHASH:"+goodHash+"\r\n"+
+		"FILE:missing.txt\r\nHASH:99999999\r\n"+
+		"FILE:bad.txt\r\nHASH:"+badHash+"\r\n")
+
+	report, err = Verify(config, "0")
+	if err == nil {
+		t.Fatalf("Verify should fail for a corrupted version")
+	}
+	if !errors.Is(err, ErrBlobMissing) || !errors.Is(err, ErrBlobCorrupt) {
+		t.Errorf("Verify error should wrap ErrBlobMissing and ErrBlobCorrupt: %v", err)
+	}
+	if report.Version != "2" || report.FilesChecked != 3 {
+		t.Errorf("Unexpected report for corrupted version: %+v", report)
+	}
+	if len(report.MissingBlobs) != 1 || report.MissingBlobs[0].Path != "missing.txt" {
+		t.Errorf("Expected missing.txt to be reported missing: %+v", report.MissingBlobs)
+	}
+	if len(report.HashMismatches) != 1 || report.HashMismatches[0].Path != "bad.txt" {
+		t.Errorf("Expected bad.txt to be reported as mismatch: %+v", report.HashMismatches)
+	}
+	if report.HashMismatches[0].Actual != corruptHash {
+		t.Errorf("Expected actual hash %s, got %s", corruptHash, report.HashMismatches[0].Actual)
+	}
+
+	if _, err := Verify(config, "3"); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("Verify of a missing version should return ErrVersionNotFound: %v", err)
+	}
+}
+
+// TestMultipleRepositories tests that independent repositories can be used at the same time
+func TestMultipleRepositories(t *testing.T) {
+	tempDir := filepath.Join(os.TempDir(), "gitstyle_repositories_integration_test")
+
+	// Clean up after test
+	os.RemoveAll(tempDir)
+	defer os.RemoveAll(tempDir)
+
+	repos := make([]*Repository, 3)
+	for i := range repos {
+		sourceDir := filepath.Join(tempDir, "source"+strconv.Itoa(i))
+		if err := os.MkdirAll(sourceDir, 0755); err != nil {
+			t.Fatalf("Failed to create source directory: %v", err)
+		}
+		content := "Content for repository " + strconv.Itoa(i)
+		if err := ioutil.WriteFile(filepath.Join(sourceDir, "file.txt"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+
+		r, err := Init(Config{
+			BackupDir: filepath.Join(tempDir, "backup"+strconv.Itoa(i)),
+			Include:   []string{sourceDir},
+		})
+		if err != nil {
+			t.Fatalf("Init of repository %d failed: %v", i, err)
+		}
+		repos[i] = r
+	}
+
+	errs := make(chan error, len(repos))
+	for _, r := range repos {
+		go func(r *Repository) {
+			errs <- r.Backup()
+		}(r)
+	}
+	for range repos {
+		if err := <-errs; err != nil {
+			t.Errorf("Concurrent backup failed: %v", err)
+		}
+	}
+
+	for i, r := range repos {
+		versions, err := r.Versions()
+		if err != nil {
+			t.Fatalf("Listing versions of repository %d failed: %v", i, err)
+		}
+		if len(versions) != 1 {
+			t.Errorf("Repository %d should have exactly one version, got %v", i, versions)
+		}
+		if _, err := r.Verify("0"); err != nil {
+			t.Errorf("Verify of repository %d failed: %v", i, err)
+		}
+	}
+
+	// A second handle on the same directory must respect the lock
+	other, err := Open(repos[0].cfg)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := repos[0].Lock(); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	if err := other.Lock(); !errors.Is(err, ErrRepositoryInUse) {
+		t.Errorf("Second lock on the same repository should return ErrRepositoryInUse: %v", err)
+	}
+	if err := repos[0].Unlock(); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if err := other.Lock(); err != nil {
+		t.Errorf("Lock after unlock should succeed: %v", err)
+	}
+	other.Unlock()
+}
+
+// TestVersionFileDeterministic tests that version files list whole records sorted by path
+func TestVersionFileDeterministic(t *testing.T) {
+	tempDir := filepath.Join(os.TempDir(), "gitstyle_manifest_integration_test")
+	sourceDir := filepath.Join(tempDir, "source")
+	backupDir := filepath.Join(tempDir, "backup")
+
+	// Clean up after test
+	os.RemoveAll(tempDir)
+	defer os.RemoveAll(tempDir)
+
+	for i := 0; i < 200; i++ {
+		dir := filepath.Join(sourceDir, "dir"+strconv.Itoa(i%7))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Failed to create source directory: %v", err)
+		}
+		content := "Content of file " + strconv.Itoa(i)
+		if err := ioutil.WriteFile(filepath.Join(dir, "file"+strconv.Itoa(i)+".txt"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	config := Config{BackupDir: backupDir, Include: []string{sourceDir}}
+	for i := 0; i < 2; i++ {
+		if err := Backup(config); err != nil {
+			t.Fatalf("Backup %d failed: %v", i+1, err)
+		}
+	}
+
+	repo, err := Open(config)
+	if err != nil {
+		t.Fatalf("Failed to open repository: %v", err)
+	}
+	readRecords := func(n int) (ManifestHeader, []ManifestEntry) {
+		var entries []ManifestEntry
+		version := nthVersion(t, config, n)
+		header, err := repo.readVersion(version, func(e ManifestEntry) error {
+			entries = append(entries, e)
+			return nil
+		}, nil)
+		if err != nil {
+			t.Fatalf("Failed to read version file %s: %v", version, err)
+		}
+		if header.Format != ManifestFormat {
+			t.Errorf("Version file %s should use format %d, got %d", version, ManifestFormat, header.Format)
+		}
+		return header, entries
+	}
+
+	header1, records1 := readRecords(1)
+	header2, records2 := readRecords(2)
+	if len(header1.Roots) != 1 || !reflect.DeepEqual(header1.Roots, header2.Roots) {
+		t.Errorf("Backups of unchanged files should share their folder tree: %v %v", header1.Roots, header2.Roots)
+	}
+	if len(records1) != 200 {
+		t.Fatalf("Expected 200 records, got %d", len(records1))
+	}
+
+	var paths []string
+	for _, e := range records1 {
+		paths = append(paths, e.Path)
+		info, err := os.Stat(e.Path)
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", e.Path, err)
+		}
+		if e.Size != info.Size() || !e.ModTime.Equal(info.ModTime()) {
+			t.Errorf("Record %s should have the exact size and time of the file", e.Path)
+		}
+	}
+	if !sort.StringsAreSorted(paths) {
+		t.Errorf("Version file records should be sorted by path")
+	}
+
+	if !reflect.DeepEqual(records1, records2) {
+		t.Errorf("Backups of unchanged files should produce identical records")
+	}
+}
+
+// TestChangeDetection tests that unchanged files reuse their hash and rehashing finds hidden changes
+func TestChangeDetection(t *testing.T) {
+	tempDir := filepath.Join(os.TempDir(), "gitstyle_change_integration_test")
+	sourceDir := filepath.Join(tempDir, "source")
+	backupDir := filepath.Join(tempDir, "backup")
+
+	// Clean up after test
+	os.RemoveAll(tempDir)
+	defer os.RemoveAll(tempDir)
+
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		t.Fatalf("Failed to create source directory: %v", err)
+	}
+	fileA := filepath.Join(sourceDir, "a.txt")
+	fileB := filepath.Join(sourceDir, "b.txt")
+	if err := ioutil.WriteFile(fileA, []byte("aaaa"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := ioutil.WriteFile(fileB, []byte("bbbb"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	config := Config{BackupDir: backupDir, Include: []string{sourceDir}}
+	if err := Backup(config); err != nil {
+		t.Fatalf("First backup failed: %v", err)
+	}
+	repo, err := Open(config)
+	if err != nil {
+		t.Fatalf("Failed to open repository: %v", err)
+	}
+	readVersion := func(n int) (ManifestHeader, map[string]ManifestEntry) {
+		entries := map[string]ManifestEntry{}
+		version := nthVersion(t, config, n)
+		header, err := repo.readVersion(version, func(e ManifestEntry) error {
+			entries[e.Path] = e
+			return nil
+		}, nil)
+		if err != nil {
+			t.Fatalf("Failed to read version file %s: %v", version, err)
+		}
+		return header, entries
+	}
+	header1, entries1 := readVersion(1)
+	if header1.FullHash.IsZero() {
+		t.Errorf("First version should record a full rehash")
+	}
+
+	// change the content without changing size or modification time
+	info, err := os.Stat(fileA)
+	if err != nil {
+		t.Fatalf("Failed to stat test file: %v", err)
+	}
+	if err := ioutil.WriteFile(fileA, []byte("cccc"), 0644); err != nil {
+		t.Fatalf("Failed to modify test file: %v", err)
+	}
+	if err := os.Chtimes(fileA, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatalf("Failed to reset modification time: %v", err)
+	}
+	expected, _ := repo.hashFile(fileA)
+
+	if err := Backup(config); err != nil {
+		t.Fatalf("Second backup failed: %v", err)
+	}
+	header2, entries2 := readVersion(2)
+	if !header2.FullHash.Equal(header1.FullHash) {
+		t.Errorf("Version without a full rehash should keep the previous rehash time")
+	}
+	if !reflect.DeepEqual(entries2[fileB], entries1[fileB]) {
+		t.Errorf("Unchanged file should reuse its entry")
+	}
+	if _, ctime := fileIdentity(info); !ctime.IsZero() && entries2[fileA].Hash != expected {
+		t.Errorf("Change time should reveal the modified file")
+	}
+
+	config.FullRehash = true
+	if err := Backup(config); err != nil {
+		t.Fatalf("Third backup failed: %v", err)
+	}
+	header3, entries3 := readVersion(3)
+	if !header3.FullHash.After(header1.FullHash) {
+		t.Errorf("Full rehash should be recorded in the version")
+	}
+	if entries3[fileA].Hash != expected {
+		t.Errorf("Full rehash should store the modified file")
+	}
+}
+
+// TestChunkedBackupRestore tests that large files share chunks between versions and restore transparently
+func TestChunkedBackupRestore(t *testing.T) {
+	tempDir := filepath.Join(os.TempDir(), "gitstyle_chunked_integration_test")
+	sourceDir := filepath.Join(tempDir, "source")
+	backupDir := filepath.Join(tempDir, "backup")
+	restoreDir := filepath.Join(tempDir, "restore")
+
+	// Clean up after test
+	os.RemoveAll(tempDir)
+	defer os.RemoveAll(tempDir)
+
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		t.Fatalf("Failed to create source directory: %v", err)
+	}
+
+	// deterministic pseudo random content, chunk boundaries need varied data
+	original := make([]byte, 256*1024)
+	x := uint32(1)
+	for i := range original {
+		x = x*1664525 + 1013904223
+		original[i] = byte(x >> 24)
+	}
+	modified := append(append(append([]byte{}, original[:100000]...), []byte("inserted bytes")...), original[100000:]...)
+
+	largeFile := filepath.Join(sourceDir, "large.bin")
+	smallFile := filepath.Join(sourceDir, "small.txt")
+	if err := ioutil.WriteFile(smallFile, []byte("small file"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	config := Config{BackupDir: backupDir, Include: []string{sourceDir}, EncryptPassword: "chunks", ChunkSizeKB: 4}
+	for i, content := range [][]byte{original, modified} {
+		if err := ioutil.WriteFile(largeFile, content, 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+		if err := Backup(config); err != nil {
+			t.Fatalf("Backup %d failed: %v", i+1, err)
+		}
+	}
+
+	chunks := func(n int) []string {
+		var result []string
+		repo, err := Open(config)
+		if err != nil {
+			t.Fatalf("Failed to open repository: %v", err)
+		}
+		version := nthVersion(t, config, n)
+		_, err = repo.readVersion(version, func(e ManifestEntry) error {
+			if e.Path == smallFile && len(e.Chunks) != 0 {
+				t.Errorf("Small files should not be chunked")
+			}
+			if e.Path == largeFile {
+				result = e.Chunks
+			}
+			return nil
+		}, nil)
+		if err != nil {
+			t.Fatalf("Failed to read version file %s: %v", version, err)
+		}
+		return result
+	}
+	chunks1, chunks2 := chunks(1), chunks(2)
+	if len(chunks1) < 10 {
+		t.Fatalf("Large file should be split into chunks, got %d", len(chunks1))
+	}
+	shared := 0
+	inFirst := map[string]bool{}
+	for _, c := range chunks1 {
+		inFirst[c] = true
+	}
+	for _, c := range chunks2 {
+		if inFirst[c] {
+			shared++
+		}
+	}
+	if shared < len(chunks2)-3 {
+		t.Errorf("An insert should only change the chunks around it, %d of %d shared", shared, len(chunks2))
+	}
+
+	// trimming version 1 must keep the chunks version 2 still uses
+	second := nthVersion(t, config, 2)
+	if _, err := Trim(config, second); err != nil {
+		t.Fatalf("Trim failed: %v", err)
+	}
+	if _, err := Verify(config, second); err != nil {
+		t.Fatalf("Verify after trim failed: %v", err)
+	}
+
+	if err := Restore(config, second, restoreDir); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	restored, err := ioutil.ReadFile(filepath.Join(restoreDir, "large.bin"))
+	if err != nil {
+		t.Fatalf("Failed to read restored file: %v", err)
+	}
+	if !bytes.Equal(restored, modified) {
+		t.Errorf("Restored chunked file does not match the original")
+	}
+}
+
+// TestPackWorkflow tests that small files are packed and trim repacks packs holding removed files
+func TestPackWorkflow(t *testing.T) {
+	tempDir := filepath.Join(os.TempDir(), "gitstyle_pack_integration_test")
+	sourceDir := filepath.Join(tempDir, "source")
+	backupDir := filepath.Join(tempDir, "backup")
+	restoreDir := filepath.Join(tempDir, "restore")
+	packDir := filepath.Join(backupDir, "Packs")
+
+	// Clean up after test
+	os.RemoveAll(tempDir)
+	defer os.RemoveAll(tempDir)
+
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		t.Fatalf("Failed to create source directory: %v", err)
+	}
+	writeFiles := func(prefix string, from, to int) {
+		for i := from; i < to; i++ {
+			content := prefix + " content of file " + strconv.Itoa(i)
+			if err := ioutil.WriteFile(filepath.Join(sourceDir, "file"+strconv.Itoa(i)+".txt"), []byte(content), 0644); err != nil {
+				t.Fatalf("Failed to create test file: %v", err)
+			}
+		}
+	}
+	packFiles := func(suffix string) []string {
+		matches, _ := filepath.Glob(filepath.Join(packDir, "*"+suffix))
+		return matches
+	}
+
+	config := Config{BackupDir: backupDir, Include: []string{sourceDir}}
+	writeFiles("first", 0, 50)
+	if err := Backup(config); err != nil {
+		t.Fatalf("First backup failed: %v", err)
+	}
+	if len(packFiles(packSuffix)) != 1 || len(packFiles(indexSuffix)) != 1 {
+		t.Fatalf("Small files should be stored in one pack with an index")
+	}
+	if loose, _ := filepath.Glob(filepath.Join(backupDir, "Files", "*", "*")); len(loose) != 0 {
+		t.Errorf("Small files should not be stored loose, found %d", len(loose))
+	}
+
+	// a repository kept open sees the packs written and repacked by others
+	repo, err := Open(config)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if _, err := repo.Verify("latest"); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+
+	writeFiles("second", 0, 20)
+	if err := Backup(config); err != nil {
+		t.Fatalf("Second backup failed: %v", err)
+	}
+	if report, err := repo.Verify("latest"); err != nil || report.FilesChecked != 50 {
+		t.Errorf("Verify of a version packed after Open failed: %+v %v", report, err)
+	}
+
+	second := nthVersion(t, config, 2)
+	result, err := Trim(config, second)
+	if err != nil {
+		t.Fatalf("Trim failed: %v", err)
+	}
+	// the folder tree of the first version is replaced too
+	if result.BlobsRemoved != 21 || result.BytesReclaimed <= 0 {
+		t.Errorf("Trim should remove the 20 replaced files and their folder tree from the pack: %+v", result)
+	}
+	if len(packFiles(packSuffix)) != 2 || len(packFiles(indexSuffix)) != 2 {
+		t.Errorf("Expected the repacked pack and the second pack, got %v", packFiles(""))
+	}
+	if err := repo.Restore("latest", filepath.Join(tempDir, "kept")); err != nil {
+		t.Errorf("Restore of a version repacked after Open failed: %v", err)
+	}
+	if result, err := repo.Trim(second); err != nil || result.VersionsRemoved != 0 {
+		t.Errorf("Trim of a repository kept open failed: %+v %v", result, err)
+	}
+
+	// a pack without an index was interrupted and is removed by fix
+	incomplete := filepath.Join(packDir, "incomplete"+packSuffix)
+	if err := ioutil.WriteFile(incomplete, []byte("partial"), 0644); err != nil {
+		t.Fatalf("Failed to create incomplete pack: %v", err)
+	}
+	if err := Fix(config); err != nil {
+		t.Fatalf("Fix failed: %v", err)
+	}
+	if exists, _ := FileExists(incomplete); exists {
+		t.Errorf("Fix should remove a pack without an index")
+	}
+
+	if report, err := Verify(config, "0"); err != nil || report.FilesChecked != 50 {
+		t.Fatalf("Verify after trim failed: %+v %v", report, err)
+	}
+	if err := Restore(config, second, restoreDir); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(restoreDir, "file30.txt"))
+	if err != nil || string(content) != "first content of file 30" {
+		t.Errorf("Unexpected restored content %q (%v)", content, err)
+	}
+	content, err = ioutil.ReadFile(filepath.Join(restoreDir, "file10.txt"))
+	if err != nil || string(content) != "second content of file 10" {
+		t.Errorf("Unexpected restored content %q (%v)", content, err)
+	}
+}
+
+// TestMigrateWorkflow tests upgrading a backup directory written before Repository.json existed
+func TestMigrateWorkflow(t *testing.T) {
+	tempDir := filepath.Join(os.TempDir(), "gitstyle_migrate_integration_test")
+	sourceDir := filepath.Join(tempDir, "source")
+	backupDir := filepath.Join(tempDir, "backup")
+	copyDir := filepath.Join(tempDir, "copy")
+
+	// Clean up after test
+	os.RemoveAll(tempDir)
+	defer os.RemoveAll(tempDir)
+
+	// lay out a format 1 backup directory by hand
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		t.Fatalf("Failed to create source directory: %v", err)
+	}
+	source := filepath.Join(sourceDir, "old.txt")
+	if err := ioutil.WriteFile(source, []byte("backed up long ago"), 0644); err != nil {
+		t.Fatalf("Failed to create source file: %v", err)
+	}
+	hash, _ := HashFile(source)
+	sHash := HashToString(hash)
+	blobDir := filepath.Join(backupDir, "Files", sHash[:2])
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		t.Fatalf("Failed to create blob directory: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(backupDir, "Version"), 0755); err != nil {
+		t.Fatalf("Failed to create version directory: %v", err)
+	}
+	if err := CopyFileAndGZip(source, filepath.Join(blobDir, sHash)); err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+	version := "VERSION:1\r\nDATE:01/02/2020 10:11:12 +0000\r\nFILE:" + source +
+		"\r\nMODDATE:01/02/2020 09:00:00 +0000\r\nSIZE:0.000017\r\nHASH:" + sHash + "\r\n"
+	if err := ioutil.WriteFile(filepath.Join(backupDir, "Version", "1"), []byte(version), 0644); err != nil {
+		t.Fatalf("Failed to write version file: %v", err)
+	}
+
+	config := Config{BackupDir: backupDir, Include: []string{sourceDir}}
+	if _, err := Verify(config, "0"); !errors.Is(err, ErrNeedsMigration) {
+		t.Fatalf("Old backup directory should need migration, got %v", err)
+	}
+	if err := Backup(config); !errors.Is(err, ErrNeedsMigration) {
+		t.Fatalf("Backup into an old backup directory should need migration, got %v", err)
+	}
+
+	// migrating a copy leaves the original untouched
+	if err := Migrate(config, copyDir); err != nil {
+		t.Fatalf("Migrate to copy failed: %v", err)
+	}
+	if exists, _ := FileExists(filepath.Join(backupDir, repositoryConfigFileName)); exists {
+		t.Errorf("Migrating a copy should not change the original")
+	}
+	copyConfig := Config{BackupDir: copyDir, Include: []string{sourceDir}}
+	if _, err := Verify(copyConfig, "0"); err != nil {
+		t.Errorf("Verify of migrated copy failed: %v", err)
+	}
+
+	if err := Migrate(config, ""); err != nil {
+		t.Fatalf("Migrate in place failed: %v", err)
+	}
+	if err := Migrate(config, ""); err != nil {
+		t.Fatalf("Migrating a current backup directory should do nothing: %v", err)
+	}
+	if err := Backup(config); err != nil {
+		t.Fatalf("Backup after migration failed: %v", err)
+	}
+	if report, err := Verify(config, "0"); err != nil || report.Version != nthVersion(t, config, 2) {
+		t.Errorf("Verify after migration failed: %+v %v", report, err)
+	}
+}
+
+// TestMigrateNewlineInFileName tests that a format 1 version listing a file
+// name with a line ending in it stays readable after migration
+func TestMigrateNewlineInFileName(t *testing.T) {
+	tempDir := filepath.Join(os.TempDir(), "gitstyle_migrate_newline_integration_test")
+	sourceDir := filepath.Join(tempDir, "source")
+	backupDir := filepath.Join(tempDir, "backup")
+
+	// Clean up after test
+	os.RemoveAll(tempDir)
+	defer os.RemoveAll(tempDir)
+
+	// lay out a format 1 backup directory the way the first releases wrote it
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		t.Fatalf("Failed to create source directory: %v", err)
+	}
+	source := filepath.Join(sourceDir, "old.txt")
+	if err := ioutil.WriteFile(source, []byte("backed up long ago"), 0644); err != nil {
+		t.Fatalf("Failed to create source file: %v", err)
+	}
+	hash, _ := HashFile(source)
+	sHash := HashToString(hash)
+	blobDir := filepath.Join(backupDir, "Files", sHash[:2])
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		t.Fatalf("Failed to create blob directory: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(backupDir, "Version"), 0755); err != nil {
+		t.Fatalf("Failed to create version directory: %v", err)
+	}
+	if err := CopyFileAndGZip(source, filepath.Join(blobDir, sHash)); err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+	newline := filepath.Join(sourceDir, "two\nlines.txt")
+	entry := func(path string) string {
+		return "FILE:" + path + "\r\nMODDATE:01/02/2020 09:00:00 +0000\r\nSIZE:0.000017\r\nHASH:" + sHash + "\r\n"
+	}
+	version := "VERSION:1\r\nDATE:01/02/2020 10:11:12 +0000\r\n" + entry(newline) + entry(source)
+	if err := ioutil.WriteFile(filepath.Join(backupDir, "Version", "1"), []byte(version), 0644); err != nil {
+		t.Fatalf("Failed to write version file: %v", err)
+	}
+
+	config := Config{BackupDir: backupDir, Include: []string{sourceDir}}
+	if err := Migrate(config, ""); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+
+	r, err := Open(config)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	var paths []string
+	if _, err := r.readVersion("1", func(e ManifestEntry) error {
+		paths = append(paths, e.Path)
+		return nil
+	}, nil); err != nil {
+		t.Fatalf("Reading the format 1 version failed: %v", err)
+	}
+	if !reflect.DeepEqual(paths, []string{newline, source}) {
+		t.Errorf("Unexpected paths %q", paths)
+	}
+	if report, err := Verify(config, "1"); err != nil || report.FilesChecked != 2 {
+		t.Errorf("Verify of the format 1 version failed: %+v %v", report, err)
+	}
+
+	if err := Backup(config); err != nil {
+		t.Fatalf("Backup after migration failed: %v", err)
+	}
+	if result, err := Trim(config, "+0"); err != nil || result.VersionsRemoved != 1 {
+		t.Errorf("Trim of the format 1 version failed: %+v %v", result, err)
+	}
+}
+
+// TestRepositoryConfigValidation tests that operations refuse backup directories they cannot use
+func TestRepositoryConfigValidation(t *testing.T) {
+	tempDir := filepath.Join(os.TempDir(), "gitstyle_repoconfig_integration_test")
+
+	// Clean up after test
+	os.RemoveAll(tempDir)
+	defer os.RemoveAll(tempDir)
+
+	plain := Config{BackupDir: filepath.Join(tempDir, "plain")}
+	encrypted := Config{BackupDir: filepath.Join(tempDir, "encrypted"), EncryptPassword: "secret"}
+	for _, cfg := range []Config{plain, encrypted} {
+		r, err := Init(cfg)
+		if err != nil {
+			t.Fatalf("Init failed: %v", err)
+		}
+		if r.Config().Format != RepositoryFormat || r.Config().ID == "" {
+			t.Errorf("Unexpected repository config %+v", r.Config())
+		}
+	}
+
+	plain.EncryptPassword = "secret"
+	if _, err := Open(plain); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Opening a plain backup directory with a key should fail, got %v", err)
+	}
+	encrypted.EncryptPassword = ""
+	if _, err := Open(encrypted); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Opening an encrypted backup directory without a key should fail, got %v", err)
+	}
+
+	configFile := filepath.Join(tempDir, "plain", repositoryConfigFileName)
+	rc, err := readRepositoryConfig(configFile)
+	if err != nil {
+		t.Fatalf("Failed to read repository config: %v", err)
+	}
+	rc.Format = RepositoryFormat + 1
+	if err := writeRepositoryConfig(configFile, rc); err != nil {
+		t.Fatalf("Failed to write repository config: %v", err)
+	}
+	plain.EncryptPassword = ""
+	if _, err := Open(plain); !errors.Is(err, ErrUnsupportedRepository) {
+		t.Errorf("Opening a newer backup directory should fail, got %v", err)
+	}
+}
+
+// TestKeysFileWorkflow tests that encrypted backup directories keep a master
+// key unlocked by the password and older ones keep their key
+func TestKeysFileWorkflow(t *testing.T) {
+	tempDir := filepath.Join(os.TempDir(), "gitstyle_keys_integration_test")
+	sourceDir := filepath.Join(tempDir, "source")
+	backupDir := filepath.Join(tempDir, "backup")
+	legacyDir := filepath.Join(tempDir, "legacy")
+
+	// Clean up after test
+	os.RemoveAll(tempDir)
+	defer os.RemoveAll(tempDir)
+
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		t.Fatalf("Failed to create source directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(sourceDir, "secret.txt"), []byte("locked away"), 0644); err != nil {
+		t.Fatalf("Failed to create source file: %v", err)
+	}
+
+	config := Config{BackupDir: backupDir, Include: []string{sourceDir}, EncryptPassword: "master", KeyCost: minKeyCost}
+	if err := Backup(config); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	r, err := Open(config)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if r.Config().KeyDerivation != keyFromKeysFile || bytes.Equal(r.key, deriveKey("master")) {
+		t.Errorf("New backup directories should encrypt with a master key, got %q", r.Config().KeyDerivation)
+	}
+	if exists, _ := FileExists(filepath.Join(backupDir, keysFileName)); !exists {
+		t.Errorf("%s should be created", keysFileName)
+	}
+	if _, err := Verify(config, "latest"); err != nil {
+		t.Errorf("Verify failed: %v", err)
+	}
+
+	wrong := config
+	wrong.EncryptPassword = "guess"
+	if _, err := Open(wrong); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Opening with a wrong password should fail with ErrWrongKey, got %v", err)
+	}
+
+	// a backup directory encrypted before format 5 keeps its key
+	legacy := Config{BackupDir: legacyDir, Include: []string{sourceDir}, EncryptPassword: "old"}
+	if _, err := Init(legacy); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	configFile := filepath.Join(legacyDir, repositoryConfigFileName)
+	rc, err := readRepositoryConfig(configFile)
+	if err != nil {
+		t.Fatalf("Failed to read repository config: %v", err)
+	}
+	rc.Format, rc.KeyDerivation, rc.KeyCheck = 4, keyFromSHA256, ""
+	if err := writeRepositoryConfig(configFile, rc); err != nil {
+		t.Fatalf("Failed to write repository config: %v", err)
+	}
+	os.Remove(filepath.Join(legacyDir, keysFileName))
+
+	if err := Migrate(legacy, ""); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if err := Backup(legacy); err != nil {
+		t.Fatalf("Backup after migration failed: %v", err)
+	}
+	r, err = Open(legacy)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if !bytes.Equal(r.key, deriveKey("old")) {
+		t.Errorf("Migrated backup directories should keep their key")
+	}
+	if _, err := Verify(legacy, "latest"); err != nil {
+		t.Errorf("Verify of migrated backup directory failed: %v", err)
+	}
+}
+
+// TestWrongKeyWorkflow tests that a wrong key is refused before anything is
+// written and encrypted and unencrypted files are never mixed
+func TestWrongKeyWorkflow(t *testing.T) {
+	tempDir := filepath.Join(os.TempDir(), "gitstyle_wrongkey_integration_test")
+	sourceDir := filepath.Join(tempDir, "source")
+	backupDir := filepath.Join(tempDir, "backup")
+	otherDir := filepath.Join(tempDir, "other")
+	legacyDir := filepath.Join(tempDir, "legacy")
+
+	// Clean up after test
+	os.RemoveAll(tempDir)
+	defer os.RemoveAll(tempDir)
+
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		t.Fatalf("Failed to create source directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(sourceDir, "file.txt"), []byte("typo safe"), 0644); err != nil {
+		t.Fatalf("Failed to create source file: %v", err)
+	}
+
+	config := Config{BackupDir: backupDir, Include: []string{sourceDir}, EncryptPassword: "secret", KeyCost: minKeyCost}
+	if err := Backup(config); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	versions, _ := ListAllVersions(config)
+
+	typo := config
+	typo.EncryptPassword = "secert"
+	if err := Backup(typo); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Backup with a wrong password should fail with ErrWrongKey, got %v", err)
+	}
+	if after, _ := ListAllVersions(config); len(after) != len(versions) {
+		t.Errorf("Backup with a wrong password should not write a version")
+	}
+
+	// Keys.json of another backup directory opens with the same password but
+	// holds another master key
+	other := config
+	other.BackupDir = otherDir
+	if _, err := Init(other); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(otherDir, keysFileName))
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", keysFileName, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(backupDir, keysFileName), data, 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", keysFileName, err)
+	}
+	if _, err := Open(config); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("A master key of another backup directory should fail the key check, got %v", err)
+	}
+
+	// the key check of a backup directory encrypted before format 6 is only
+	// recorded for a key opening its files
+	legacy := Config{BackupDir: legacyDir, Include: []string{sourceDir}, EncryptPassword: "old"}
+	if _, err := Init(legacy); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	configFile := filepath.Join(legacyDir, repositoryConfigFileName)
+	rc, err := readRepositoryConfig(configFile)
+	if err != nil {
+		t.Fatalf("Failed to read repository config: %v", err)
+	}
+	rc.KeyDerivation, rc.KeyCheck = keyFromSHA256, keyCheck(deriveKey("old"), rc.ID)
+	rc.HashAlgorithm = hashSHA256
+	if err := writeRepositoryConfig(configFile, rc); err != nil {
+		t.Fatalf("Failed to write repository config: %v", err)
+	}
+	os.Remove(filepath.Join(legacyDir, keysFileName))
+	if err := Backup(legacy); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	rc.Format, rc.KeyCheck = 5, ""
+	if err := writeRepositoryConfig(configFile, rc); err != nil {
+		t.Fatalf("Failed to write repository config: %v", err)
+	}
+	// format 5 wrote version files and pack indexes in plain text
+	for _, dir := range []string{"Version", "Packs"} {
+		paths, _ := filepath.Glob(filepath.Join(legacyDir, dir, "*"))
+		for _, path := range paths {
+			if strings.HasSuffix(path, ".pack") {
+				continue
+			}
+			data, err := readSealedFile(path, deriveKey("old"))
+			if err != nil {
+				t.Fatalf("Failed to decrypt %s: %v", path, err)
+			}
+			if err := ioutil.WriteFile(path, data, 0644); err != nil {
+				t.Fatalf("Failed to write %s: %v", path, err)
+			}
+		}
+	}
+
+	legacyTypo := legacy
+	legacyTypo.EncryptPassword = "odl"
+	if err := Migrate(legacyTypo, ""); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Migrating with a wrong password should fail with ErrWrongKey, got %v", err)
+	}
+	if rc, _ := readRepositoryConfig(configFile); rc.Format != 5 || rc.KeyCheck != "" {
+		t.Errorf("A failed migration should not record a key check: %+v", rc)
+	}
+	if err := Migrate(legacy, ""); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	// stored files keep their names, renaming them would rewrite every version
+	if rc, _ := readRepositoryConfig(configFile); rc.Format != RepositoryFormat || rc.HashAlgorithm != hashSHA256 {
+		t.Errorf("Migration should keep the names of stored files: %+v", rc)
+	}
+	if _, err := Verify(legacy, "latest"); err != nil {
+		t.Errorf("Verify after migration failed: %v", err)
+	}
+	if err := Backup(legacyTypo); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Backup with a wrong password should fail after migration, got %v", err)
+	}
+
+	// a stored file that is not encrypted is reported as such
+	plainDir := filepath.Join(tempDir, "plain")
+	plain := Config{BackupDir: plainDir, Include: []string{sourceDir}}
+	if err := Backup(plain); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	pr, err := Open(plain)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	raw, _, err := pr.anyStoredFile()
+	if err != nil || raw == nil {
+		t.Fatalf("Failed to find a stored file: %v", err)
+	}
+	defer raw.Close()
+	if _, err := newStoredFileReader(raw, deriveKey("old")); !errors.Is(err, ErrBlobCorrupt) || !strings.Contains(err.Error(), "not encrypted") {
+		t.Errorf("An unencrypted file should be reported as not encrypted, got %v", err)
+	}
+}
+
+// TestCorruptEncryptedBlobWorkflow tests that a damaged file of an encrypted
+// backup directory is reported as corrupt, the key was checked at Open
+func TestCorruptEncryptedBlobWorkflow(t *testing.T) {
+	tempDir := filepath.Join(os.TempDir(), "gitstyle_corrupt_encrypted_integration_test")
+	sourceDir := filepath.Join(tempDir, "source")
+	backupDir := filepath.Join(tempDir, "backup")
+
+	// Clean up after test
+	os.RemoveAll(tempDir)
+	defer os.RemoveAll(tempDir)
+
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		t.Fatalf("Failed to create source directory: %v", err)
+	}
+	// content gzip cannot shrink is stored loose in several segments
+	data := make([]byte, 5*streamSegmentSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := ioutil.WriteFile(filepath.Join(sourceDir, "large.bin"), data, 0644); err != nil {
+		t.Fatalf("Failed to create source file: %v", err)
+	}
+
+	config := Config{BackupDir: backupDir, Include: []string{sourceDir}, EncryptPassword: "secret", KeyCost: minKeyCost}
+	if err := Backup(config); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	var blob string
+	var size int64
+	filepath.Walk(filepath.Join(backupDir, "Files"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && info.Size() > size {
+			blob, size = path, info.Size()
+		}
+		return nil
+	})
+	if size < int64(len(data)) {
+		t.Fatalf("Expected the large file to be stored loose, largest stored file has %d bytes", size)
+	}
+	stored, err := ioutil.ReadFile(blob)
+	if err != nil {
+		t.Fatalf("Failed to read stored file: %v", err)
+	}
+	stored[streamHeaderSize+4*(streamSegmentSize+16)+10] ^= 1
+	if err := ioutil.WriteFile(blob, stored, 0644); err != nil {
+		t.Fatalf("Failed to write stored file: %v", err)
+	}
+
+	if _, err := Verify(config, "latest"); !errors.Is(err, ErrBlobCorrupt) || errors.Is(err, ErrWrongKey) {
+		t.Errorf("Verify should report a damaged file as ErrBlobCorrupt, got %v", err)
+	}
+	err = Restore(config, "latest", filepath.Join(tempDir, "restore"))
+	if !errors.Is(err, ErrBlobCorrupt) || errors.Is(err, ErrWrongKey) {
+		t.Errorf("Restore should report a damaged file as ErrBlobCorrupt, got %v", err)
+	}
+}
+
+// TestEncryptedMetadataWorkflow tests that version files, pack indexes and
+// restore state of an encrypted backup directory do not reveal file names
+func TestEncryptedMetadataWorkflow(t *testing.T) {
+	tempDir := filepath.Join(os.TempDir(), "gitstyle_metadata_integration_test")
+	sourceDir := filepath.Join(tempDir, "source")
+	backupDir := filepath.Join(tempDir, "backup")
+	restoreDir := filepath.Join(tempDir, "restore")
+
+	// Clean up after test
+	os.RemoveAll(tempDir)
+	defer os.RemoveAll(tempDir)
+
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		t.Fatalf("Failed to create source directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(sourceDir, "salary-review.txt"), []byte("confidential"), 0644); err != nil {
+		t.Fatalf("Failed to create source file: %v", err)
+	}
+
+	config := Config{BackupDir: backupDir, Include: []string{sourceDir}, EncryptPassword: "hr", KeyCost: minKeyCost, Message: "salary-review"}
+	if err := Backup(config); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if err := Tag(config, "latest", "reviewed"); err != nil {
+		t.Fatalf("Tag failed: %v", err)
+	}
+
+	for _, pattern := range []string{"Version/*", "Packs/*" + indexSuffix} {
+		paths, _ := filepath.Glob(filepath.Join(backupDir, pattern))
+		if len(paths) == 0 {
+			t.Fatalf("No files found for %s", pattern)
+		}
+		for _, path := range paths {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Failed to read %s: %v", path, err)
+			}
+			if !isStream(data) || bytes.Contains(data, []byte("salary-review")) || bytes.Contains(data, []byte("reviewed")) {
+				t.Errorf("%s should be encrypted", path)
+			}
+		}
+	}
+
+	headers, err := ListVersions(config)
+	if err != nil || len(headers) != 1 || headers[0].Message != "salary-review" || !containsString(headers[0].Tags, "reviewed") {
+		t.Fatalf("Unexpected versions %+v: %v", headers, err)
+	}
+	if _, err := Verify(config, "reviewed"); err != nil {
+		t.Errorf("Verify failed: %v", err)
+	}
+	if err := Restore(config, "reviewed", restoreDir); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(restoreDir, "salary-review.txt")); err != nil || string(content) != "confidential" {
+		t.Errorf("Unexpected restored content %q: %v", content, err)
+	}
+
+	// the restore state is encrypted too
+	r, err := Open(config)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	stateFile := filepath.Join(tempDir, restoreStateFileName)
+	state := RestoreState{Version: headers[0].Version, CopiedFiles: []string{filepath.Join(sourceDir, "salary-review.txt")}}
+	if err := saveRestoreState(stateFile, r.key, state); err != nil {
+		t.Fatalf("Failed to save restore state: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(stateFile); bytes.Contains(data, []byte("salary-review")) {
+		t.Errorf("Restore state should be encrypted")
+	}
+	if loaded, err := loadRestoreState(stateFile, r.key); err != nil || !reflect.DeepEqual(loaded.CopiedFiles, state.CopiedFiles) {
+		t.Errorf("Unexpected restore state %+v: %v", loaded, err)
+	}
+	if _, err := loadRestoreState(stateFile, nil); err == nil {
+		t.Errorf("Loading an encrypted restore state without a key should fail")
+	}
+
+	// a version file in plain text is refused
+	plain := filepath.Join(backupDir, "Version", headers[0].Version)
+	data, err := readSealedFile(plain, r.key)
+	if err != nil {
+		t.Fatalf("Failed to decrypt version file: %v", err)
+	}
+	if err := ioutil.WriteFile(plain, data, 0644); err != nil {
+		t.Fatalf("Failed to write version file: %v", err)
+	}
+	if _, err := Verify(config, headers[0].Version); !errors.Is(err, ErrCorruptManifest) {
+		t.Errorf("A version file in plain text should be corrupt, got %v", err)
+	}
+}
+
+// TestKeySlotWorkflow tests that passwords are added, changed and removed
+// without touching stored files
+func TestKeySlotWorkflow(t *testing.T) {
+	tempDir := filepath.Join(os.TempDir(), "gitstyle_keyslot_integration_test")
+	sourceDir := filepath.Join(tempDir, "source")
+	backupDir := filepath.Join(tempDir, "backup")
+
+	// Clean up after test
+	os.RemoveAll(tempDir)
+	defer os.RemoveAll(tempDir)
+
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		t.Fatalf("Failed to create source directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(sourceDir, "shared.txt"), []byte("two admins"), 0644); err != nil {
+		t.Fatalf("Failed to create source file: %v", err)
+	}
+
+	first := Config{BackupDir: backupDir, Include: []string{sourceDir}, EncryptPassword: "first", KeyCost: minKeyCost}
+	if err := Backup(first); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	second := first
+	second.EncryptPassword = "second"
+	slot, err := AddKey(first, "admin2", second)
+	if err != nil {
+		t.Fatalf("AddKey failed: %v", err)
+	}
+	if slot.Name != "admin2" || slot.ID == "" {
+		t.Errorf("Unexpected new key slot %+v", slot)
+	}
+	if _, err := AddKey(first, "again", second); err == nil {
+		t.Errorf("Adding a password that already unlocks a slot should fail")
+	}
+	if _, err := Verify(second, "latest"); err != nil {
+		t.Errorf("Verify with the added password failed: %v", err)
+	}
+
+	slots, err := Keys(second)
+	if err != nil || len(slots) != 2 {
+		t.Fatalf("Expected 2 key slots, got %+v: %v", slots, err)
+	}
+	if slots[0].Current || !slots[1].Current {
+		t.Errorf("The slot of the added password should be current: %+v", slots)
+	}
+	firstID := slots[0].ID
+
+	// changing a password leaves the other slot working
+	third := first
+	third.EncryptPassword = "third"
+	if err := ChangeKey(second, third); err != nil {
+		t.Fatalf("ChangeKey failed: %v", err)
+	}
+	if _, err := Open(second); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("The changed password should no longer open the backup directory, got %v", err)
+	}
+	if _, err := Verify(third, "latest"); err != nil {
+		t.Errorf("Verify with the changed password failed: %v", err)
+	}
+	if slots, _ := Keys(third); len(slots) != 2 || slots[1].Name != "admin2" {
+		t.Errorf("Changing a password should keep the slot name: %+v", slots)
+	}
+
+	if err := RemoveKey(third, firstID); err != nil {
+		t.Fatalf("RemoveKey failed: %v", err)
+	}
+	if _, err := Open(first); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("A removed password should no longer open the backup directory, got %v", err)
+	}
+	if err := RemoveKey(third, "admin2"); err == nil {
+		t.Errorf("Removing the last key slot should fail")
+	}
+	if _, err := Verify(third, "latest"); err != nil {
+		t.Errorf("Verify after removing a key slot failed: %v", err)
+	}
+}
+
+// TestTreeDiffWorkflow tests that unchanged folders share their tree and diff lists the changed files
+func TestTreeDiffWorkflow(t *testing.T) {
+	tempDir := filepath.Join(os.TempDir(), "gitstyle_tree_integration_test")
+	sourceDir := filepath.Join(tempDir, "source")
+	backupDir := filepath.Join(tempDir, "backup")
+	restoreDir := filepath.Join(tempDir, "restore")
+
+	// Clean up after test
+	os.RemoveAll(tempDir)
+	defer os.RemoveAll(tempDir)
+
+	writeFile := func(name, content string) {
+		path := filepath.Join(sourceDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create source directory: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+	writeFile(filepath.Join("a", "x.txt"), "x")
+	writeFile(filepath.Join("a", "y.txt"), "y")
+	writeFile(filepath.Join("b", "z.txt"), "z")
+	writeFile(filepath.Join("b", "sub", "w.txt"), "w")
+	if err := os.MkdirAll(filepath.Join(sourceDir, "empty"), 0755); err != nil {
+		t.Fatalf("Failed to create empty directory: %v", err)
+	}
+
+	config := Config{BackupDir: backupDir, Include: []string{sourceDir}}
+	if err := Backup(config); err != nil {
+		t.Fatalf("First backup failed: %v", err)
+	}
+
+	writeFile(filepath.Join("a", "x.txt"), "x changed")
+	if err := os.Remove(filepath.Join(sourceDir, "b", "z.txt")); err != nil {
+		t.Fatalf("Failed to remove test file: %v", err)
+	}
+	writeFile(filepath.Join("c", "new.txt"), "new")
+	if err := Backup(config); err != nil {
+		t.Fatalf("Second backup failed: %v", err)
+	}
+
+	r, err := Open(config)
+	if err != nil {
+		t.Fatalf("Failed to open repository: %v", err)
+	}
+	subTree := func(n int) string {
+		header, err := r.versionHeader(nthVersion(t, config, n))
+		if err != nil || len(header.Roots) != 1 {
+			t.Fatalf("Version %d should have one root: %v", n, err)
+		}
+		hash := header.Roots[0].Tree
+		for _, name := range []string{"b", "sub"} {
+			entries, err := r.readTree(hash)
+			if err != nil {
+				t.Fatalf("Failed to read tree: %v", err)
+			}
+			for _, e := range entries {
+				if e.Name == name {
+					hash = e.Hash
+				}
+			}
+		}
+		return hash
+	}
+	if subTree(1) != subTree(2) {
+		t.Errorf("An unchanged folder should keep its tree")
+	}
+
+	diff, err := Diff(config, "latest~1", "0")
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+	expected := VersionDiff{
+		From:     nthVersion(t, config, 1),
+		To:       nthVersion(t, config, 2),
+		Added:    []string{filepath.Join(sourceDir, "c", "new.txt")},
+		Removed:  []string{filepath.Join(sourceDir, "b", "z.txt")},
+		Modified: []string{filepath.Join(sourceDir, "a", "x.txt")},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Expected diff %+v, got %+v", expected, diff)
+	}
+
+	if diff, err := Diff(config, "latest", "latest"); err != nil || len(diff.Added)+len(diff.Removed)+len(diff.Modified) != 0 {
+		t.Errorf("A version should not differ from itself: %+v %v", diff, err)
+	}
+
+	if err := Restore(config, "latest", restoreDir); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(restoreDir, "b", "sub", "w.txt"))
+	if err != nil || string(data) != "w" {
+		t.Errorf("Restored file does not match: %q %v", data, err)
+	}
+}
+
+// TestTrailingSeparatorInclude tests that an include path with a trailing
+// separator stores the same trees as without it
+func TestTrailingSeparatorInclude(t *testing.T) {
+	tempDir := filepath.Join(os.TempDir(), "gitstyle_trailing_integration_test")
+	sourceDir := filepath.Join(tempDir, "source")
+	backupDir := filepath.Join(tempDir, "backup")
+
+	// Clean up after test
+	os.RemoveAll(tempDir)
+	defer os.RemoveAll(tempDir)
+
+	if err := os.MkdirAll(filepath.Join(sourceDir, "sub"), 0755); err != nil {
+		t.Fatalf("Failed to create source directory: %v", err)
+	}
+	for _, name := range []string{"a.txt", filepath.Join("sub", "b.txt")} {
+		if err := ioutil.WriteFile(filepath.Join(sourceDir, name), []byte(name), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	config := Config{BackupDir: backupDir, Include: []string{sourceDir}}
+	if err := Backup(config); err != nil {
+		t.Fatalf("First backup failed: %v", err)
+	}
+	config.Include = []string{sourceDir + string(filepath.Separator)}
+	if err := Backup(config); err != nil {
+		t.Fatalf("Second backup failed: %v", err)
+	}
+
+	headers, err := ListVersions(config)
+	if err != nil || len(headers) != 2 {
+		t.Fatalf("Expected two versions: %v", err)
+	}
+	first, second := headers[0], headers[1]
+	if len(first.Roots) != 1 || len(second.Roots) != 1 {
+		t.Fatalf("Each version should have one root: %+v %+v", first.Roots, second.Roots)
+	}
+	if first.Roots[0] != second.Roots[0] {
+		t.Errorf("A trailing separator should store the same root: %+v and %+v", first.Roots[0], second.Roots[0])
+	}
+	if second.Totals.NewBlobs != 0 {
+		t.Errorf("A trailing separator should store nothing new, stored %d files", second.Totals.NewBlobs)
+	}
+}
+
+// TestVersionMetadata tests that versions record who made them, why and what they stored
+func TestVersionMetadata(t *testing.T) {
+	tempDir := filepath.Join(os.TempDir(), "gitstyle_metadata_integration_test")
+	sourceDir := filepath.Join(tempDir, "source")
+	backupDir := filepath.Join(tempDir, "backup")
+
+	// Clean up after test
+	os.RemoveAll(tempDir)
+	defer os.RemoveAll(tempDir)
+
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		t.Fatalf("Failed to create source directory: %v", err)
+	}
+	for i, content := range []string{"one", "two", "three"} {
+		if err := ioutil.WriteFile(filepath.Join(sourceDir, "file"+strconv.Itoa(i)+".txt"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	config := Config{BackupDir: backupDir, Include: []string{sourceDir}}
+	if err := Backup(config); err != nil {
+		t.Fatalf("First backup failed: %v", err)
+	}
+	tagged := config
+	tagged.Message = "before the upgrade\r\nof the server"
+	tagged.Tags = []string{"upgrade", "monthly"}
+	if err := Backup(tagged); err != nil {
+		t.Fatalf("Second backup failed: %v", err)
+	}
+
+	bad := config
+	bad.Tags = []string{"12"}
+	if err := Backup(bad); err == nil {
+		t.Errorf("A numeric tag should be rejected")
+	}
+
+	headers, err := ListVersions(config)
+	if err != nil {
+		t.Fatalf("ListVersions failed: %v", err)
+	}
+	if len(headers) != 2 {
+		t.Fatalf("Expected 2 versions, got %d", len(headers))
+	}
+
+	first, second := headers[0], headers[1]
+	if first.Parent != "" || second.Parent != first.Version {
+		t.Errorf("Unexpected parents %q and %q", first.Parent, second.Parent)
+	}
+	if first.Host == "" || first.Program != ProgramVersion || first.ConfigHash == "" {
+		t.Errorf("Version should record where and how it was made: %+v", first)
+	}
+	if first.ConfigHash != second.ConfigHash || !reflect.DeepEqual(first.Includes, config.Include) {
+		t.Errorf("Versions of the same config should record the same config")
+	}
+	if first.Totals != (VersionTotals{Files: 3, Bytes: 11, NewBlobs: 4}) {
+		t.Errorf("Unexpected totals of the first version %+v", first.Totals)
+	}
+	if second.Totals.NewBlobs != 0 || second.Totals.Files != 3 {
+		t.Errorf("Unchanged backup should store nothing new: %+v", second.Totals)
+	}
+	if second.Message != tagged.Message || !reflect.DeepEqual(second.Tags, tagged.Tags) {
+		t.Errorf("Message and tags not recorded: %q %v", second.Message, second.Tags)
+	}
+}
+
+func TestTagWorkflow(t *testing.T) {
+	tempDir := filepath.Join(os.TempDir(), "gitstyle_tag_integration_test")
+	sourceDir := filepath.Join(tempDir, "source")
+	backupDir := filepath.Join(tempDir, "backup")
+	restoreDir := filepath.Join(tempDir, "restore")
+
+	// Clean up after test
+	os.RemoveAll(tempDir)
+	defer os.RemoveAll(tempDir)
+
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		t.Fatalf("Failed to create source directory: %v", err)
+	}
+	testFile := filepath.Join(sourceDir, "file.txt")
+
+	// Four versions, each with different content
+	config := Config{BackupDir: backupDir, Include: []string{sourceDir}}
+	for i := 1; i <= 4; i++ {
+		if err := ioutil.WriteFile(testFile, []byte("content "+strconv.Itoa(i)), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+		if err := Backup(config); err != nil {
+			t.Fatalf("Backup %d failed: %v", i, err)
+		}
+	}
+
+	first, second, fourth := nthVersion(t, config, 1), nthVersion(t, config, 2), nthVersion(t, config, 4)
+	if err := Tag(config, first, "release"); err != nil {
+		t.Fatalf("Tag failed: %v", err)
+	}
+	if err := Tag(config, "latest~1", "release"); err == nil {
+		t.Errorf("A tag on another version should be rejected")
+	}
+	if err := Tag(config, "release", "first"); err != nil {
+		t.Fatalf("Tag by tag failed: %v", err)
+	}
+	if err := Pin(config, second[:len(second)-4]); err != nil {
+		t.Fatalf("Pin failed: %v", err)
+	}
+
+	result, err := Trim(config, "+0")
+	if err != nil {
+		t.Fatalf("Trim failed: %v", err)
+	}
+	if result.VersionsRemoved != 1 || result.VersionsProtected != 2 {
+		t.Errorf("Expected 1 version removed and 2 kept, got %+v", result)
+	}
+
+	headers, err := ListVersions(config)
+	if err != nil {
+		t.Fatalf("ListVersions failed: %v", err)
+	}
+	if len(headers) != 3 || headers[0].Version != first || headers[1].Version != second || headers[2].Version != fourth {
+		t.Fatalf("Unexpected versions after trim: %+v", headers)
+	}
+	if !reflect.DeepEqual(headers[0].Tags, []string{"release", "first"}) || !headers[1].Pinned {
+		t.Errorf("Tags and pin not kept: %v %v", headers[0].Tags, headers[1].Pinned)
+	}
+
+	// The tagged version keeps its files and can be used by name
+	report, err := Verify(config, "release")
+	if err != nil || report.Version != first {
+		t.Fatalf("Verify by tag failed: %v %+v", err, report)
+	}
+	diff, err := Diff(config, "first", "0")
+	if err != nil {
+		t.Fatalf("Diff by tag failed: %v", err)
+	}
+	if diff.From != first || diff.To != fourth || len(diff.Modified) != 1 {
+		t.Errorf("Unexpected diff %+v", diff)
+	}
+	if err := Restore(config, "release", restoreDir); err != nil {
+		t.Fatalf("Restore by tag failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(restoreDir, "file.txt"))
+	if err != nil || string(data) != "content 1" {
+		t.Errorf("Restored tagged version has wrong content %q: %v", data, err)
+	}
+
+	if err := Restore(config, "missing", restoreDir); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("Expected ErrVersionNotFound for an unknown tag, got %v", err)
+	}
+
+	// Without their tag and pin the old versions are trimmed
+	if err := Untag(config, "release", "first"); err != nil {
+		t.Fatalf("Untag failed: %v", err)
+	}
+	if err := Unpin(config, second); err != nil {
+		t.Fatalf("Unpin failed: %v", err)
+	}
+	result, err = Trim(config, "+0")
+	if err != nil {
+		t.Fatalf("Second trim failed: %v", err)
+	}
+	if result.VersionsRemoved != 2 || result.VersionsProtected != 0 {
+		t.Errorf("Expected 2 versions removed, got %+v", result)
+	}
+}
+
+func TestSourceWorkflow(t *testing.T) {
+	tempDir := filepath.Join(os.TempDir(), "gitstyle_source_integration_test")
+	backupDir := filepath.Join(tempDir, "backup")
+	restoreDir := filepath.Join(tempDir, "restore")
+
+	// Clean up after test
+	os.RemoveAll(tempDir)
+	defer os.RemoveAll(tempDir)
+
+	// Two machines backing up to the same backup directory
+	configs := map[string]Config{}
+	for _, source := range []string{"alpha", "beta"} {
+		sourceDir := filepath.Join(tempDir, source)
+		if err := os.MkdirAll(sourceDir, 0755); err != nil {
+			t.Fatalf("Failed to create source directory: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(sourceDir, "shared.txt"), []byte("same on both"), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+		configs[source] = Config{BackupDir: backupDir, Include: []string{sourceDir}, Source: source}
+	}
+
+	for i, source := range []string{"alpha", "beta", "alpha", "beta", "alpha"} {
+		file := filepath.Join(tempDir, source, "own.txt")
+		if err := ioutil.WriteFile(file, []byte(source+" "+strconv.Itoa(i)), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+		if err := Backup(configs[source]); err != nil {
+			t.Fatalf("Backup %d of %s failed: %v", i+1, source, err)
+		}
+	}
+
+	versionsOf := func(source string) []string {
+		headers, err := ListVersions(configs[source])
+		if err != nil {
+			t.Fatalf("ListVersions of %s failed: %v", source, err)
+		}
+		var versions []string
+		for _, h := range headers {
+			if h.Source != source {
+				t.Errorf("Version %s of %s recorded source %q", h.Version, source, h.Source)
+			}
+			versions = append(versions, h.Version)
+		}
+		return versions
+	}
+	v := func(n int) string { return nthVersion(t, configs["alpha"], n) }
+	if got := versionsOf("alpha"); !reflect.DeepEqual(got, []string{v(1), v(3), v(5)}) {
+		t.Errorf("Unexpected alpha versions %v", got)
+	}
+	beta := []string{v(2), v(4)}
+	if got := versionsOf("beta"); !reflect.DeepEqual(got, beta) {
+		t.Errorf("Unexpected beta versions %v", got)
+	}
+
+	all, err := ListAllVersions(configs["alpha"])
+	if err != nil {
+		t.Fatalf("ListAllVersions failed: %v", err)
+	}
+	if len(all) != 5 || all[3].Parent != v(2) || all[4].Parent != v(3) {
+		t.Errorf("Versions should follow their own source: %+v", all)
+	}
+
+	// The shared file is stored once for both sources
+	if all[1].Totals.NewBlobs >= all[0].Totals.NewBlobs {
+		t.Errorf("Second source should reuse stored files, stored %d after %d", all[1].Totals.NewBlobs, all[0].Totals.NewBlobs)
+	}
+
+	// Trimming one source never touches the other
+	result, err := Trim(configs["alpha"], "+0")
+	if err != nil {
+		t.Fatalf("Trim failed: %v", err)
+	}
+	if result.VersionsRemoved != 2 {
+		t.Errorf("Expected 2 alpha versions removed, got %+v", result)
+	}
+	if got := versionsOf("beta"); !reflect.DeepEqual(got, beta) {
+		t.Errorf("Trim of alpha changed beta versions %v", got)
+	}
+
+	report, err := Verify(configs["beta"], "0")
+	if err != nil || report.Version != beta[1] {
+		t.Fatalf("Verify of the newest beta version failed: %v %+v", err, report)
+	}
+	if _, err := Verify(configs["beta"], beta[0]); err != nil {
+		t.Fatalf("Verify of the first beta version failed: %v", err)
+	}
+
+	if err := Restore(configs["alpha"], "0", restoreDir); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(restoreDir, "own.txt"))
+	if err != nil || string(data) != "alpha 4" {
+		t.Errorf("Restore of version 0 should restore the newest alpha version, got %q: %v", data, err)
+	}
+}
+
+// nthVersion returns the version written by the n-th backup to a backup
+// directory, counting from 1
+func nthVersion(t *testing.T, config Config, n int) string {
+	t.Helper()
+	r, err := Open(config)
+	if err != nil {
+		t.Fatalf("Failed to open repository: %v", err)
+	}
+	versions, err := r.Versions()
+	if err != nil || len(versions) < n {
+		t.Fatalf("Backup directory should have %d versions: %v %v", n, versions, err)
+	}
+	return versions[n-1]
+}
+
+func TestVersionSelectors(t *testing.T) {
+	tempDir := filepath.Join(os.TempDir(), "gitstyle_selector_integration_test")
+	sourceDir := filepath.Join(tempDir, "source")
+	backupDir := filepath.Join(tempDir, "backup")
+
+	// Clean up after test
+	os.RemoveAll(tempDir)
+	defer os.RemoveAll(tempDir)
+
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		t.Fatalf("Failed to create source directory: %v", err)
+	}
+	config := Config{BackupDir: backupDir, Include: []string{sourceDir}}
+	for i := 1; i <= 3; i++ {
+		if err := ioutil.WriteFile(filepath.Join(sourceDir, "file.txt"), []byte(strconv.Itoa(i)), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+		if err := Backup(config); err != nil {
+			t.Fatalf("Backup %d failed: %v", i, err)
+		}
+	}
+
+	r, err := Open(config)
+	if err != nil {
+		t.Fatalf("Failed to open repository: %v", err)
+	}
+	versions, err := r.Versions()
+	if err != nil || len(versions) != 3 {
+		t.Fatalf("Expected 3 versions: %v %v", versions, err)
+	}
+	for _, ver := range versions {
+		if !validVersionID(ver) {
+			t.Errorf("Backup should name its version, got %q", ver)
+		}
+	}
+
+	today := time.Now().Format("2006-01-02")
+	cases := map[string]string{
+		"0":                              versions[2],
+		"latest":                         versions[2],
+		"latest~2":                       versions[0],
+		versions[1]:                      versions[1],
+		versions[1][:27]:                 versions[1],
+		today:                            versions[2],
+		versions[0][:len(versions[0])-2]: versions[0],
+	}
+	for value, expected := range cases {
+		got, err := r.resolveVersion(value)
+		if err != nil || got != expected {
+			t.Errorf("resolveVersion(%q) = %q, %v, expected %q", value, got, err, expected)
+		}
+	}
+
+	for _, value := range []string{"latest~3", "latest~x", "2000-01-01", "2026", "-1", "nothing"} {
+		if _, err := r.resolveVersion(value); err == nil {
+			t.Errorf("resolveVersion(%q) should fail", value)
+		}
+	}
+	if _, err := r.resolveVersion(versions[0][:8]); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("An ambiguous prefix should not select a version: %v", err)
+	}
+}
@@ -255,14 +255,14 @@ func TestBackupIntegration(t *testing.T) {
 
 	// Test trim functionality
 	t.Run("TrimOperation", func(t *testing.T) {
-		if err := gitstylebackup.Trim(cfg, "1"); err != nil {
+		if _, err := gitstylebackup.Trim(cfg, "latest"); err != nil {
 			t.Errorf("Trim failed: %v", err)
 		}
 	})
 
 	// Test verify functionality
 	t.Run("VerifyOperation", func(t *testing.T) {
-		if err := gitstylebackup.Verify(cfg, "1"); err != nil {
+		if _, err := gitstylebackup.Verify(cfg, "latest"); err != nil {
 			t.Errorf("Verify failed: %v", err)
 		}
 	})
@@ -342,7 +342,7 @@ func TestErrorHandling(t *testing.T) {
 			Include:   []string{tc.tempDir},
 			Priority:  "3",
 		}
-		if err := gitstylebackup.Trim(cfg, "invalid"); err == nil {
+		if _, err := gitstylebackup.Trim(cfg, "invalid"); err == nil {
 			t.Error("Expected error for invalid trim version")
 		}
 	})
@@ -353,7 +353,7 @@ func TestErrorHandling(t *testing.T) {
 			Include:   []string{tc.tempDir},
 			Priority:  "3",
 		}
-		if err := gitstylebackup.Verify(cfg, "invalid"); err == nil {
+		if _, err := gitstylebackup.Verify(cfg, "invalid"); err == nil {
 			t.Error("Expected error for invalid verify version")
 		}
 	})
@@ -397,6 +397,10 @@ func TestFixOperations(t *testing.T) {
 		if err := os.WriteFile(orphanFile, []byte("orphan"), 0644); err != nil {
 			t.Fatalf("Failed to create orphan file: %v", err)
 		}
+		tempFile := filepath.Join(orphanDir, "orphan.123.tmp")
+		if err := os.WriteFile(tempFile, []byte("partial"), 0644); err != nil {
+			t.Fatalf("Failed to create temp file: %v", err)
+		}
 
 		// Run fix
 		if err := gitstylebackup.Fix(cfg); err != nil {
@@ -407,6 +411,9 @@ func TestFixOperations(t *testing.T) {
 		if _, err := os.Stat(orphanFile); !os.IsNotExist(err) {
 			t.Error("Orphan file should have been removed")
 		}
+		if _, err := os.Stat(tempFile); !os.IsNotExist(err) {
+			t.Error("Leftover temp file should have been removed")
+		}
 	})
 
 	t.Run("FixInUse", func(t *testing.T) {